@@ -20,12 +20,12 @@ package kubeconfig
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	restclient "k8s.io/client-go/rest"
 
@@ -40,15 +40,34 @@ import (
 var kubeRestConfig *restclient.Config
 
 // clientSet api calls
-var clientSet *kubernetes.Clientset
+var clientSet kubernetes.Interface
 
 // KubeConfig options to configure endPtDefn
 type KubeConfig struct {
-	File         string `json:"file"          doc:"yaml format file to import mappings from\n        name:\n          source: host:port\n          sink:   host:port\n        " default:"/var/lib/forwarder/pipes.yaml"`
-	Debug        bool   `json:"debug"         doc:"increase verboseness"`
-	KubeConfig   string `json:"kubeconfig"    doc:"kubernetes auth secrets / configuration file"`
-	UseInCluster bool   `json:"useincluster"  doc:"use incluster configuration options" default:"true"`
-	Kubernetes   bool   `json:"kubernetes"    doc:"using kubernetes configuration, and enable endpoint load from a service name, if not, skip cluster config option parsing" default:"true"`
+	File         string        `json:"file"          doc:"yaml format file to import mappings from\n        name:\n          source: host:port\n          sink:   host:port\n        " default:"/var/lib/forwarder/pipes.yaml"`
+	KubeConfig   string        `json:"kubeconfig"    doc:"kubernetes auth secrets / configuration file"`
+	UseInCluster bool          `json:"useincluster"  doc:"use incluster configuration options" default:"true"`
+	Kubernetes   bool          `json:"kubernetes"    doc:"using kubernetes configuration, and enable endpoint load from a service name, if not, skip cluster config option parsing" default:"true"`
+	Admin        string        `json:"admin"         doc:"admin api listen address host:port, disabled when empty"`
+	Metrics      string        `json:"metrics"       doc:"prometheus /metrics listen address host:port, disabled when empty" default:":9495"`
+	Drain        time.Duration `json:"drain"         doc:"on SIGTERM or SIGINT wait this long for active pipes to finish before closing them" default:"25s"`
+	AccessLog    string        `json:"accesslog"     doc:"write a record of each completed pipe to stdout or this file, disabled when empty"`
+	AccessFormat string        `json:"accessformat"  doc:"access log format, json or a go text/template over the record's fields" default:"json"`
+	AccessSize   int           `json:"accesssize"    doc:"rotate the access log file at this many megabytes" default:"100"`
+	AccessKeep   int           `json:"accesskeep"    doc:"rotated access log files to keep, 0 keeps all" default:"5"`
+	AccessAge    int           `json:"accessage"     doc:"days to keep rotated access log files, 0 keeps them regardless of age"`
+	LogLevel     string        `json:"loglevel"      doc:"log level trace, debug, info, warn or error, trace adds call traces, changed at runtime with the admin api's /loglevel" default:"info"`
+	LogFormat    string        `json:"logformat"     doc:"log format text or json" default:"text"`
+	Debug        bool          `json:"debug"         doc:"deprecated, loglevel debug unless loglevel is set"`
+}
+
+// Level to log at, loglevel or debug for the deprecated debug option
+// when loglevel is left at info
+func (kubeConfig *KubeConfig) Level() string {
+	if kubeConfig.Debug && kubeConfig.LogLevel == "info" {
+		return "debug"
+	}
+	return kubeConfig.LogLevel
 }
 
 // CheckInCluster reports if the env variable is set for cluster
@@ -78,44 +97,23 @@ func (kubeConfig *KubeConfig) LoadKubeConfig() {
 // ErrorHandler print error message based on error type
 func ErrorHandler(name string, err error) {
 	if errors.IsNotFound(err) {
-		log.Printf("%s not found\n", name)
+		slog.Warn("not found", "name", name)
 	} else if statusError, isStatus := err.(*errors.StatusError); isStatus {
-		log.Printf("Error getting %s %v\n", name, statusError.ErrStatus.Message)
+		slog.Error("get failed", "name", name, "err", statusError.ErrStatus.Message)
 	} else if err != nil {
 		panic(err.Error())
 	} else {
-		log.Printf("Found %s\n", name)
+		slog.Debug("found", "name", name)
 	}
 }
 
-// Endpoints for a service name in the given namespace
-func Endpoints(name, namespace string) (endpoints []string) {
-	if clientSet != nil {
-		var eps *v1.EndpointsList
-		var err error
-		// use the current context in kubeconfig
-		eps, err = clientSet.CoreV1().Endpoints(namespace).List(metav1.ListOptions{})
-		if err != nil {
-			panic(err.Error())
-		}
-		for _, ep := range eps.Items {
-			meta := ep.ObjectMeta
-			if name == meta.Name {
-				for _, set := range ep.Subsets {
-					for _, address := range set.Addresses {
-						for _, port := range set.Ports {
-							if len(meta.Namespace) > 0 {
-								namespace = meta.Namespace
-							}
-							// // fmt.Println(namespace, meta.Name)
-							// name := meta.Name
-							// // fmt.Printf("%s %s:%d\n", ep.Metadata, address.IP, port.Port)
-							// fmt.Printf("%s:%d\n", address.IP, port.Port)
-							endpoint := fmt.Sprintf("%s:%d", address.IP, port.Port)
-							endpoints = append(endpoints, endpoint)
-						}
-					}
-				}
+// Addresses host:port pairs for every ready address and port of ep
+func Addresses(ep *v1.Endpoints) (endpoints []string) {
+	for _, set := range ep.Subsets {
+		for _, address := range set.Addresses {
+			for _, port := range set.Ports {
+				endpoint := fmt.Sprintf("%s:%d", address.IP, port.Port)
+				endpoints = append(endpoints, endpoint)
 			}
 		}
 	}
@@ -0,0 +1,19 @@
+package kubeconfig
+
+import "testing"
+
+func TestLevel(t *testing.T) {
+	for _, test := range []struct {
+		config KubeConfig
+		level  string
+	}{
+		{KubeConfig{LogLevel: "info"}, "info"},
+		{KubeConfig{LogLevel: "info", Debug: true}, "debug"},
+		{KubeConfig{LogLevel: "trace", Debug: true}, "trace"},
+		{KubeConfig{LogLevel: "warn"}, "warn"},
+	} {
+		if level := test.config.Level(); level != test.level {
+			t.Errorf("%+v expected %s got %s", test.config, test.level, level)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package kubeconfig
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// WatchEndpoints for a service name in the given namespace, update is
+// called with the service's host:port list on every add, change or
+// delete until done is closed
+func WatchEndpoints(name, namespace string, update func([]string), done <-chan bool) {
+	if clientSet != nil {
+		Watcher(clientSet, name, namespace, update, done)
+	}
+}
+
+// Watcher run an endpoints informer against client for the named
+// service, returns once the informer has started
+func Watcher(client kubernetes.Interface, name, namespace string, update func([]string), done <-chan bool) {
+	var stop = make(chan struct{})
+	go func() {
+		<-done
+		close(stop)
+	}()
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+
+	// selectors aren't honored by every client, so check the name too
+	var changed = func(obj interface{}) {
+		if ep, ok := obj.(*v1.Endpoints); ok && ep.ObjectMeta.Name == name {
+			update(Addresses(ep))
+		}
+	}
+
+	informer := factory.Core().V1().Endpoints().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: changed,
+		UpdateFunc: func(old, obj interface{}) {
+			changed(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if ep, ok := obj.(*v1.Endpoints); ok && ep.ObjectMeta.Name == name {
+				update(nil)
+			}
+		},
+	})
+	factory.Start(stop)
+}
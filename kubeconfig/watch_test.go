@@ -0,0 +1,61 @@
+package kubeconfig
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func endpoints(name, namespace string, port int32, ips ...string) *v1.Endpoints {
+	var addresses []v1.EndpointAddress
+	for _, ip := range ips {
+		addresses = append(addresses, v1.EndpointAddress{IP: ip})
+	}
+	return &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: addresses,
+				Ports:     []v1.EndpointPort{{Port: port}},
+			},
+		},
+	}
+}
+
+func expect(t *testing.T, updates chan []string, want []string) {
+	select {
+	case got := <-updates:
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Unexpected endpoints:\nGot:\t\t%v\nExpected:\t%v\n", got, want)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("timed out waiting for endpoints %v", want)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		endpoints("echo", "default", 8080, "10.2.0.1"),
+		endpoints("other", "default", 22, "10.2.0.9"),
+	)
+	var updates = make(chan []string, 10)
+	var done = make(chan bool)
+	defer close(done)
+
+	Watcher(client, "echo", "default", func(eps []string) { updates <- eps }, done)
+	expect(t, updates, []string{"10.2.0.1:8080"})
+
+	if _, err := client.CoreV1().Endpoints("default").Update(endpoints("echo", "default", 8080, "10.2.0.1", "10.2.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, updates, []string{"10.2.0.1:8080", "10.2.0.2:8080"})
+
+	if err := client.CoreV1().Endpoints("default").Delete("echo", &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, updates, nil)
+}
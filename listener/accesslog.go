@@ -0,0 +1,101 @@
+package listener
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Access log of completed pipes, disabled when nil
+var Access *AccessLog
+
+// AccessRecord one completed pipe, bytes in are client to sink, bytes
+// out are sink to client
+type AccessRecord struct {
+	Pipe     string    `json:"pipe"`
+	ID       uint64    `json:"id"`
+	Client   string    `json:"client"`
+	Sink     string    `json:"sink"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration"`
+	BytesIn  uint64    `json:"bytes-in"`
+	BytesOut uint64    `json:"bytes-out"`
+	Reason   string    `json:"reason"`
+}
+
+// AccessLog writes an AccessRecord per line as json or through a text
+// template
+type AccessLog struct {
+	mutex    sync.Mutex
+	writer   io.Writer
+	template *template.Template
+}
+
+// NewAccessLog to output, stdout or a file path rotated at maxSize
+// megabytes keeping maxBackups old files for maxAge days, 0 for no
+// limit. format is json or a text/template over AccessRecord
+func NewAccessLog(output, format string, maxSize, maxBackups, maxAge int) (*AccessLog, error) {
+	var writer io.Writer = os.Stdout
+	if output != "stdout" && output != "-" {
+		writer = &lumberjack.Logger{
+			Filename:   output,
+			MaxSize:    maxSize,
+			MaxBackups: maxBackups,
+			MaxAge:     maxAge,
+		}
+	}
+	return newAccessLog(writer, format)
+}
+
+// newAccessLog writing records to writer in format
+func newAccessLog(writer io.Writer, format string) (*AccessLog, error) {
+	var accessLog = &AccessLog{writer: writer}
+	if len(format) > 0 && format != "json" {
+		var err error
+		if accessLog.template, err = template.New("access").Parse(format); err != nil {
+			return nil, err
+		}
+	}
+	return accessLog, nil
+}
+
+// Log record as one line
+func (a *AccessLog) Log(record AccessRecord) {
+	if a == nil {
+		return
+	}
+	var line bytes.Buffer
+	if a.template == nil {
+		json.NewEncoder(&line).Encode(record)
+	} else if err := a.template.Execute(&line, record); err != nil {
+		slog.Error("access log failed", "pipe", record.Pipe, "id", record.ID, "err", err)
+		return
+	}
+	if line.Len() == 0 || line.Bytes()[line.Len()-1] != '\n' {
+		line.WriteByte('\n')
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, err := a.writer.Write(line.Bytes()); err != nil {
+		slog.Error("access log failed", "pipe", record.Pipe, "id", record.ID, "err", err)
+	}
+}
+
+// Close the log's file
+func (a *AccessLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	if closer, ok := a.writer.(io.Closer); ok && a.writer != os.Stdout {
+		return closer.Close()
+	}
+	return nil
+}
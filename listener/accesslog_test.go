@@ -0,0 +1,112 @@
+package listener
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidwalter0/forwarder/kubeconfig"
+)
+
+// lines collects what's written for concurrent readers
+type lines struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (l *lines) Write(b []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.Buffer.Write(b)
+}
+
+func (l *lines) String() string {
+	l.Lock()
+	defer l.Unlock()
+	return l.Buffer.String()
+}
+
+// wait up to a few seconds for n lines
+func (l *lines) wait(t *testing.T, n int) []string {
+	for deadline := time.Now().Add(time.Second * 5); time.Now().Before(deadline); time.Sleep(time.Millisecond * 20) {
+		if text := l.String(); strings.Count(text, "\n") >= n {
+			return strings.Split(strings.TrimSpace(text), "\n")
+		}
+	}
+	t.Fatalf("expected %d lines got %q", n, l.String())
+	return nil
+}
+
+func TestAccessLogFormat(t *testing.T) {
+	var record = AccessRecord{Pipe: "web", ID: 7, Client: "10.0.0.1:5000", Sink: "10.0.0.2:80",
+		Start: time.Unix(0, 0).UTC(), End: time.Unix(2, 0).UTC(), Duration: 2, BytesIn: 10, BytesOut: 20, Reason: "eof"}
+	var out lines
+	accessLog, err := newAccessLog(&out, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessLog.Log(record)
+	var logged AccessRecord
+	if err = json.Unmarshal([]byte(out.String()), &logged); err != nil || logged != record {
+		t.Errorf("expected %+v got %+v %v", record, logged, err)
+	}
+
+	out.Reset()
+	if accessLog, err = newAccessLog(&out, "{{.Pipe}} {{.Client}} {{.Sink}} {{.BytesIn}}/{{.BytesOut}} {{.Reason}}"); err != nil {
+		t.Fatal(err)
+	}
+	accessLog.Log(record)
+	if expected := "web 10.0.0.1:5000 10.0.0.2:80 10/20 eof\n"; out.String() != expected {
+		t.Errorf("expected %q got %q", expected, out.String())
+	}
+
+	if _, err = newAccessLog(&out, "{{.Pipe"); err == nil {
+		t.Error("expected a template error")
+	}
+	// a nil log is disabled
+	var disabled *AccessLog
+	disabled.Log(record)
+}
+
+func TestAccessLog(t *testing.T) {
+	var out lines
+	defer func(accessLog *AccessLog) { Access = accessLog }(Access)
+	Access, _ = newAccessLog(&out, "{{.Pipe}} {{.Client}} {{.Sink}} {{.BytesIn}} {{.BytesOut}} {{.Reason}}")
+
+	sink := echo(t)
+	defer sink.Close()
+	ml := NewManagedListener("logged", &PipeDefinition{
+		Source: "127.0.0.1:0",
+		Sink:   sink.Addr().String(),
+	}, kubeconfig.KubeConfig{})
+	ml.Open()
+	defer ml.Close()
+
+	conn, err := net.Dial("tcp", ml.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	CloseWrite(conn)
+	ioutil.ReadAll(conn)
+	var fields = strings.Fields(out.wait(t, 1)[0])
+	if expected := []string{"logged", conn.LocalAddr().String(), sink.Addr().String(), "4", "4", "eof"}; !StringsEqual(fields, expected) {
+		t.Errorf("expected %v got %v", expected, fields)
+	}
+
+	conn, ok := open(t, ml.Listener.Addr().String())
+	if !ok {
+		t.Fatal("expected a connection")
+	}
+	defer conn.Close()
+	ml.ClosePipe(ml.Pipes.Snapshot()[0].ID)
+	if fields = strings.Fields(out.wait(t, 2)[1]); fields[len(fields)-1] != "admin" {
+		t.Errorf("expected closed by admin got %v", fields)
+	}
+}
@@ -0,0 +1,89 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ACL source address allow and deny lists, a client matching deny is
+// refused, as is one not matching a non empty allow
+type ACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	// allowing true when allow was set, even if nothing in it parsed
+	allowing bool
+}
+
+// ParseCIDR parse a CIDR or a single address as it's /32 or /128
+func ParseCIDR(text string) (*net.IPNet, error) {
+	if !strings.Contains(text, "/") {
+		ip := net.ParseIP(text)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", text)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(text)
+	return network, err
+}
+
+// NewACL parse the allow and deny lists, entries that don't parse are
+// skipped and returned in err. A skipped allow entry narrows access
+// but a skipped deny entry widens it, validation rejects both before a
+// pipes file is applied
+func NewACL(allow, deny []string) (acl *ACL, err error) {
+	acl = &ACL{allowing: len(allow) > 0}
+	var invalid []string
+	for _, list := range []struct {
+		texts []string
+		nets  *[]*net.IPNet
+	}{{allow, &acl.allow}, {deny, &acl.deny}} {
+		for _, text := range list.texts {
+			network, e := ParseCIDR(text)
+			if e != nil {
+				invalid = append(invalid, e.Error())
+				continue
+			}
+			*list.nets = append(*list.nets, network)
+		}
+	}
+	if len(invalid) > 0 {
+		err = fmt.Errorf("%s", strings.Join(invalid, ", "))
+	}
+	return
+}
+
+// Allowed reports if addr may connect
+func (acl *ACL) Allowed(addr net.Addr) bool {
+	if acl == nil || (!acl.allowing && len(acl.deny) == 0) {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		// not an ip client, only an open list lets it through
+		return !acl.allowing
+	}
+	for _, network := range acl.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if !acl.allowing {
+		return true
+	}
+	for _, network := range acl.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package listener
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/davidwalter0/forwarder/kubeconfig"
+)
+
+var _acls = []struct {
+	allow   []string
+	deny    []string
+	client  net.Addr
+	allowed bool
+}{
+	{nil, nil, tcp("203.0.113.7:1"), true},
+	{[]string{"203.0.113.0/24"}, nil, tcp("203.0.113.7:1"), true},
+	{[]string{"203.0.113.0/24"}, nil, tcp("198.51.100.7:1"), false},
+	{[]string{"203.0.113.0/24"}, []string{"203.0.113.7"}, tcp("203.0.113.7:1"), false},
+	{[]string{"203.0.113.0/24"}, []string{"203.0.113.7"}, tcp("203.0.113.8:1"), true},
+	{nil, []string{"203.0.113.0/24"}, tcp("198.51.100.7:1"), true},
+	{nil, []string{"203.0.113.0/24"}, &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 1}, false},
+	{[]string{"2001:db8::/32"}, nil, tcp("[2001:db8::1]:1"), true},
+	{[]string{"2001:db8::/32"}, nil, tcp("[2001:db9::1]:1"), false},
+	// ipv4 clients of a dual stack listener
+	{[]string{"203.0.113.0/24"}, nil, tcp("[::ffff:203.0.113.7]:1"), true},
+	// nothing parsed still restricts
+	{[]string{"office"}, nil, tcp("203.0.113.7:1"), false},
+	{[]string{"203.0.113.0/24"}, nil, &net.UnixAddr{Name: "/tmp/s", Net: "unix"}, false},
+	{nil, []string{"203.0.113.0/24"}, &net.UnixAddr{Name: "/tmp/s", Net: "unix"}, true},
+}
+
+func TestACL(t *testing.T) {
+	for _, test := range _acls {
+		acl, _ := NewACL(test.allow, test.deny)
+		if allowed := acl.Allowed(test.client); allowed != test.allowed {
+			t.Errorf("allow %v deny %v %v expected %v got %v", test.allow, test.deny, test.client, test.allowed, allowed)
+		}
+	}
+}
+
+func TestDeny(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+
+	ml := NewManagedListener("denied", &PipeDefinition{
+		Source: "127.0.0.1:0",
+		Sink:   sink.Addr().String(),
+		Deny:   []string{"127.0.0.0/8"},
+	}, kubeconfig.KubeConfig{})
+	ml.Open()
+	defer ml.Close()
+	if conn, ok := open(t, ml.Listener.Addr().String()); ok {
+		conn.Close()
+		t.Fatal("expected the loopback client denied")
+	}
+
+	// allowed by the address in the PROXY header rather than the
+	// balancer's
+	if err := ml.Update(&PipeDefinition{
+		Source:              "127.0.0.1:0",
+		Sink:                sink.Addr().String(),
+		AcceptProxyProtocol: true,
+		Allow:               []string{"203.0.113.0/24"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for client, allowed := range map[string]bool{"203.0.113.7:51000": true, "198.51.100.7:51000": false} {
+		conn, err := net.Dial("tcp", ml.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		WriteProxyHeader(conn, "v1", tcp(client), tcp("127.0.0.1:1"))
+		conn.Write([]byte("ping"))
+		var reply = make([]byte, 4)
+		_, err = conn.Read(reply)
+		if (err == nil) != allowed {
+			t.Errorf("%s expected allowed %v got %v", client, allowed, err)
+		}
+		conn.Close()
+	}
+}
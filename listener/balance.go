@@ -0,0 +1,206 @@
+package listener
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Balancer selects the endpoint for each new connection
+type Balancer interface {
+	// Next endpoint for client, endpoints is never empty
+	Next(client net.Addr, endpoints []string) string
+	// Done a connection to endpoint returned by Next has closed
+	Done(endpoint string)
+}
+
+// Balancers by the name used in the balance field of pipes.yaml
+var Balancers = map[string]func(weights map[string]int) Balancer{
+	"round-robin":          func(map[string]int) Balancer { return &RoundRobin{} },
+	"least-connections":    func(map[string]int) Balancer { return &LeastConnections{} },
+	"random-two-choices":   func(map[string]int) Balancer { return &RandomTwoChoices{} },
+	"weighted-round-robin": func(weights map[string]int) Balancer { return &WeightedRoundRobin{Weights: weights} },
+	"consistent-hash":      func(map[string]int) Balancer { return &ConsistentHash{} },
+}
+
+// NewBalancer by name, empty is round-robin
+func NewBalancer(name string, weights map[string]int) (Balancer, error) {
+	if len(name) == 0 {
+		name = "round-robin"
+	}
+	if create, ok := Balancers[name]; ok {
+		return create(weights), nil
+	}
+	return nil, fmt.Errorf("unknown balance %q", name)
+}
+
+// host part of a host:port pair, or address if there's no port
+func host(address string) string {
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		return h
+	}
+	return address
+}
+
+// RoundRobin rotate through the endpoints
+type RoundRobin struct {
+	n uint64
+}
+
+// Next endpoint in turn
+func (b *RoundRobin) Next(client net.Addr, endpoints []string) string {
+	return endpoints[atomic.AddUint64(&b.n, 1)%uint64(len(endpoints))]
+}
+
+// Done nothing to track
+func (b *RoundRobin) Done(endpoint string) {}
+
+// connections active per endpoint
+type connections struct {
+	sync.Mutex
+	active map[string]int
+}
+
+// add n to endpoint's count, forgetting idle endpoints
+func (c *connections) add(endpoint string, n int) {
+	c.Lock()
+	defer c.Unlock()
+	if c.active == nil {
+		c.active = make(map[string]int)
+	}
+	c.active[endpoint] += n
+	if c.active[endpoint] <= 0 {
+		delete(c.active, endpoint)
+	}
+}
+
+// LeastConnections pick the endpoint with the fewest active
+// connections, ties go to the first listed
+type LeastConnections struct {
+	connections
+}
+
+// Next least loaded endpoint
+func (b *LeastConnections) Next(client net.Addr, endpoints []string) string {
+	b.Lock()
+	var best = endpoints[0]
+	for _, endpoint := range endpoints[1:] {
+		if b.active[endpoint] < b.active[best] {
+			best = endpoint
+		}
+	}
+	b.Unlock()
+	b.add(best, 1)
+	return best
+}
+
+// Done release endpoint's connection
+func (b *LeastConnections) Done(endpoint string) {
+	b.add(endpoint, -1)
+}
+
+// RandomTwoChoices pick two endpoints at random and use the one with
+// fewer active connections
+type RandomTwoChoices struct {
+	connections
+}
+
+// Next less loaded of two random endpoints
+func (b *RandomTwoChoices) Next(client net.Addr, endpoints []string) string {
+	var best = endpoints[rand.Intn(len(endpoints))]
+	if len(endpoints) > 1 {
+		other := endpoints[rand.Intn(len(endpoints))]
+		b.Lock()
+		if b.active[other] < b.active[best] {
+			best = other
+		}
+		b.Unlock()
+	}
+	b.add(best, 1)
+	return best
+}
+
+// Done release endpoint's connection
+func (b *RandomTwoChoices) Done(endpoint string) {
+	b.add(endpoint, -1)
+}
+
+// WeightedRoundRobin smooth weighted rotation, Weights are keyed by
+// host:port or host, unlisted endpoints weigh 1
+type WeightedRoundRobin struct {
+	Weights map[string]int
+	mutex   sync.Mutex
+	current map[string]int
+}
+
+// weight configured for endpoint
+func (b *WeightedRoundRobin) weight(endpoint string) int {
+	if w, ok := b.Weights[endpoint]; ok {
+		return w
+	}
+	if w, ok := b.Weights[host(endpoint)]; ok {
+		return w
+	}
+	return 1
+}
+
+// Next endpoint, each call raises every endpoint by it's weight and
+// picks the highest, which is then lowered by the total
+func (b *WeightedRoundRobin) Next(client net.Addr, endpoints []string) string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var current = make(map[string]int, len(endpoints))
+	var best string
+	var total int
+	for _, endpoint := range endpoints {
+		weight := b.weight(endpoint)
+		if weight <= 0 {
+			continue
+		}
+		total += weight
+		current[endpoint] = b.current[endpoint] + weight
+		if len(best) == 0 || current[endpoint] > current[best] {
+			best = endpoint
+		}
+	}
+	if len(best) == 0 {
+		return endpoints[0]
+	}
+	current[best] -= total
+	b.current = current
+	return best
+}
+
+// Done nothing to track
+func (b *WeightedRoundRobin) Done(endpoint string) {}
+
+// ConsistentHash pin each client ip to an endpoint using rendezvous
+// hashing, so a change in endpoints only moves the clients of the
+// endpoints added or removed
+type ConsistentHash struct{}
+
+// Next endpoint with the highest hash of client ip and endpoint
+func (b *ConsistentHash) Next(client net.Addr, endpoints []string) string {
+	var ip string
+	if client != nil {
+		ip = host(client.String())
+	}
+	var best string
+	var max uint64
+	for _, endpoint := range endpoints {
+		h := fnv.New64a()
+		h.Write([]byte(ip))
+		h.Write([]byte{0})
+		h.Write([]byte(endpoint))
+		if score := h.Sum64(); len(best) == 0 || score > max {
+			best, max = endpoint, score
+		}
+	}
+	return best
+}
+
+// Done nothing to track
+func (b *ConsistentHash) Done(endpoint string) {}
@@ -0,0 +1,95 @@
+package listener
+
+import (
+	"net"
+	"testing"
+)
+
+var _endpoints = []string{"10.2.0.1:80", "10.2.0.2:80", "10.2.0.3:80"}
+
+func client(address string) net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", address)
+	return addr
+}
+
+func TestNewBalancer(t *testing.T) {
+	for _, name := range []string{"", "round-robin", "least-connections", "random-two-choices", "weighted-round-robin", "consistent-hash"} {
+		if b, err := NewBalancer(name, nil); err != nil || b == nil {
+			t.Errorf("%q %v", name, err)
+		}
+	}
+	if _, err := NewBalancer("fastest", nil); err == nil {
+		t.Errorf("expected error for unknown balance")
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	var b = &RoundRobin{}
+	var seen = make(map[string]int)
+	for i := 0; i < 9; i++ {
+		seen[b.Next(nil, _endpoints)]++
+	}
+	for _, endpoint := range _endpoints {
+		if seen[endpoint] != 3 {
+			t.Errorf("%s chosen %d times %v", endpoint, seen[endpoint], seen)
+		}
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	var b = &LeastConnections{}
+	first := b.Next(nil, _endpoints)
+	second := b.Next(nil, _endpoints)
+	third := b.Next(nil, _endpoints)
+	if first == second || second == third || first == third {
+		t.Fatalf("expected spread %s %s %s", first, second, third)
+	}
+	b.Done(second)
+	if next := b.Next(nil, _endpoints); next != second {
+		t.Errorf("expected released %s got %s", second, next)
+	}
+}
+
+func TestRandomTwoChoices(t *testing.T) {
+	var b = &RandomTwoChoices{}
+	var seen = make(map[string]int)
+	for i := 0; i < 300; i++ {
+		seen[b.Next(nil, _endpoints)]++
+	}
+	for _, endpoint := range _endpoints {
+		if seen[endpoint] < 50 {
+			t.Errorf("%s chosen %d times %v", endpoint, seen[endpoint], seen)
+		}
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	var b = &WeightedRoundRobin{Weights: map[string]int{"10.2.0.1:80": 5, "10.2.0.2": 0}}
+	var seen = make(map[string]int)
+	for i := 0; i < 60; i++ {
+		seen[b.Next(nil, _endpoints)]++
+	}
+	if seen["10.2.0.1:80"] != 50 || seen["10.2.0.2:80"] != 0 || seen["10.2.0.3:80"] != 10 {
+		t.Errorf("unexpected spread %v", seen)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	var b = &ConsistentHash{}
+	var pinned = make(map[string]string)
+	for _, address := range []string{"192.168.1.1:1000", "192.168.1.2:1000", "192.168.1.3:1000", "192.168.1.4:1000"} {
+		pinned[address] = b.Next(client(address), _endpoints)
+		// another port from the same ip lands on the same endpoint
+		if other := b.Next(client(host(address)+":2000"), _endpoints); other != pinned[address] {
+			t.Errorf("%s moved from %s to %s", address, pinned[address], other)
+		}
+	}
+	// removing an endpoint only moves the clients that were on it
+	var removed = _endpoints[0]
+	for address, endpoint := range pinned {
+		next := b.Next(client(address), _endpoints[1:])
+		if endpoint != removed && next != endpoint {
+			t.Errorf("%s moved from %s to %s", address, endpoint, next)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package listener
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Bandwidth token bucket limits in bytes per second applied to each
+// direction, across all of a pipe's connections and per client host
+type Bandwidth struct {
+	Rate        int `json:"rate"         help:"bytes per second in each direction shared by the pipe's connections, unset unlimited"`
+	Burst       int `json:"burst"        help:"bytes sent at once before rate applies, rate when unset"`
+	ClientRate  int `json:"client-rate"  yaml:"client-rate" help:"bytes per second in each direction shared by one client host's connections, unset unlimited"`
+	ClientBurst int `json:"client-burst" yaml:"client-burst" help:"bytes a client sends at once before client-rate applies, client-rate when unset"`
+}
+
+// BandwidthEqual compares two bandwidth definitions
+func BandwidthEqual(lhs, rhs *Bandwidth) bool {
+	if lhs == nil || rhs == nil {
+		return lhs == rhs
+	}
+	return *lhs == *rhs
+}
+
+// buckets one token bucket for each direction
+type buckets struct {
+	in, out *rate.Limiter
+}
+
+// newBuckets for bytesPerSecond, nil when unlimited
+func newBuckets(bytesPerSecond, burst int) *buckets {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = bytesPerSecond
+	}
+	return &buckets{
+		in:  rate.NewLimiter(rate.Limit(bytesPerSecond), burst),
+		out: rate.NewLimiter(rate.Limit(bytesPerSecond), burst),
+	}
+}
+
+// clientBuckets a client's buckets and it's connections using them
+type clientBuckets struct {
+	*buckets
+	connections int
+}
+
+// Throttle a listener's bandwidth buckets, the pipe's and one per
+// client host with connections open
+type Throttle struct {
+	Bandwidth
+	mutex   sync.Mutex
+	pipe    *buckets
+	clients map[string]*clientBuckets
+}
+
+// NewThrottle for bandwidth, nil when bandwidth is unset
+func NewThrottle(bandwidth *Bandwidth) *Throttle {
+	if bandwidth == nil || (bandwidth.Rate <= 0 && bandwidth.ClientRate <= 0) {
+		return nil
+	}
+	return &Throttle{
+		Bandwidth: *bandwidth,
+		pipe:      newBuckets(bandwidth.Rate, bandwidth.Burst),
+		clients:   make(map[string]*clientBuckets),
+	}
+}
+
+// Acquire the limiters for a connection from client, in for client to
+// sink and out for sink to client, Release when it closes
+func (t *Throttle) Acquire(client string) (in, out []*rate.Limiter) {
+	if t == nil {
+		return
+	}
+	if t.pipe != nil {
+		in, out = append(in, t.pipe.in), append(out, t.pipe.out)
+	}
+	if t.ClientRate <= 0 {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	cb, ok := t.clients[client]
+	if !ok {
+		cb = &clientBuckets{buckets: newBuckets(t.ClientRate, t.ClientBurst)}
+		t.clients[client] = cb
+	}
+	cb.connections++
+	return append(in, cb.in), append(out, cb.out)
+}
+
+// Release client's connection, forgetting it's buckets with it's last
+func (t *Throttle) Release(client string) {
+	if t == nil || t.ClientRate <= 0 {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if cb, ok := t.clients[client]; ok {
+		if cb.connections--; cb.connections <= 0 {
+			delete(t.clients, client)
+		}
+	}
+}
+
+// throttled writer waiting on each limiter before writing, in chunks
+// no larger than the smallest burst
+type throttled struct {
+	io.Writer
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+// Write at the limiters' rate
+func (w throttled) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		var chunk = len(b)
+		for _, limiter := range w.limiters {
+			if limiter.Burst() < chunk {
+				chunk = limiter.Burst()
+			}
+		}
+		for _, limiter := range w.limiters {
+			if err = limiter.WaitN(w.ctx, chunk); err != nil {
+				return
+			}
+		}
+		var written int
+		written, err = w.Writer.Write(b[:chunk])
+		n += written
+		if err != nil {
+			return
+		}
+		b = b[chunk:]
+	}
+	return
+}
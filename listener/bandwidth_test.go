@@ -0,0 +1,77 @@
+package listener
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/davidwalter0/forwarder/kubeconfig"
+)
+
+func TestThrottle(t *testing.T) {
+	if NewThrottle(nil) != nil || NewThrottle(&Bandwidth{}) != nil {
+		t.Fatal("expected no throttle without a rate")
+	}
+	var throttle = NewThrottle(&Bandwidth{Rate: 1000, ClientRate: 100, ClientBurst: 10})
+	in, out := throttle.Acquire("a")
+	if len(in) != 2 || len(out) != 2 || in[0] == out[0] || in[1].Burst() != 10 || in[0].Burst() != 1000 {
+		t.Fatalf("expected pipe and client limiters per direction got %v %v", in, out)
+	}
+	again, _ := throttle.Acquire("a")
+	other, _ := throttle.Acquire("b")
+	if again[1] != in[1] || other[1] == in[1] || other[0] != in[0] {
+		t.Error("expected a client's connections to share it's buckets and every client the pipe's")
+	}
+	throttle.Release("a")
+	throttle.Release("a")
+	throttle.Release("b")
+	if len(throttle.clients) != 0 {
+		t.Errorf("expected clients forgotten got %d", len(throttle.clients))
+	}
+}
+
+// timed transfer of size bytes from the client through address
+func transfer(t *testing.T, address string, size int) time.Duration {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	var start = time.Now()
+	go func() {
+		conn.Write(bytes.Repeat([]byte("x"), size))
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+	received, err := ioutil.ReadAll(conn)
+	if err != nil || len(received) != size {
+		t.Fatalf("expected %d bytes back got %d %v", size, len(received), err)
+	}
+	return time.Since(start)
+}
+
+func TestBandwidth(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+	ml := NewManagedListener("throttled", &PipeDefinition{
+		Source:    "127.0.0.1:0",
+		Sink:      sink.Addr().String(),
+		Bandwidth: &Bandwidth{ClientRate: 20000, ClientBurst: 4000},
+	}, kubeconfig.KubeConfig{})
+	ml.Open()
+	defer ml.Close()
+
+	// 4000 burst then 16000 at 20000/s
+	if elapsed := transfer(t, ml.Listener.Addr().String(), 20000); elapsed < time.Millisecond*600 || elapsed > time.Second*3 {
+		t.Errorf("expected about 800ms at the client rate took %v", elapsed)
+	}
+	// unthrottled once updated
+	if err := ml.Update(&PipeDefinition{Source: "127.0.0.1:0", Sink: sink.Addr().String()}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := transfer(t, ml.Listener.Addr().String(), 20000); elapsed > time.Millisecond*500 {
+		t.Errorf("expected the update to lift the limit took %v", elapsed)
+	}
+}
@@ -0,0 +1,274 @@
+package listener
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/davidwalter0/forwarder/metrics"
+)
+
+// HealthCheck probes a pipe's sink or endpoints
+type HealthCheck struct {
+	Type     string        `json:"type"     help:"tcp (default) connect, send-expect or http GET"`
+	Interval time.Duration `json:"interval" help:"time between checks of each target, default 10s"`
+	Timeout  time.Duration `json:"timeout"  help:"bound on each check, default 2s"`
+	Rise     int           `json:"rise"     help:"consecutive passes to mark a target healthy, default 2"`
+	Fall     int           `json:"fall"     help:"consecutive failures to mark a target unhealthy, default 3"`
+	Send     string        `json:"send"     help:"send-expect text written after connecting"`
+	Expect   string        `json:"expect"   help:"send-expect text that must appear in the reply"`
+	Path     string        `json:"path"     help:"http path to GET, default /"`
+}
+
+// HealthEqual compares two health check definitions
+func HealthEqual(lhs, rhs *HealthCheck) bool {
+	if lhs == nil || rhs == nil {
+		return lhs == rhs
+	}
+	return *lhs == *rhs
+}
+
+// Defaults fill in unset values
+func (hc HealthCheck) Defaults() HealthCheck {
+	if len(hc.Type) == 0 {
+		hc.Type = "tcp"
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = time.Second * 10
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = time.Second * 2
+	}
+	if hc.Rise <= 0 {
+		hc.Rise = 2
+	}
+	if hc.Fall <= 0 {
+		hc.Fall = 3
+	}
+	if len(hc.Path) == 0 {
+		hc.Path = "/"
+	}
+	return hc
+}
+
+// Check target once
+func (hc HealthCheck) Check(target string) error {
+	switch hc.Type {
+	case "tcp":
+		conn, err := Dial("tcp", target, hc.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case "send-expect":
+		return hc.sendExpect(target)
+	case "http":
+		client := http.Client{Timeout: hc.Timeout}
+		var url = "http://" + target + hc.Path
+		if path, ok := UnixPath(target); ok {
+			client.Transport = &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", path)
+			}}
+			url = "http://localhost" + hc.Path
+		}
+		response, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode >= 400 {
+			return fmt.Errorf("http status %s", response.Status)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown health check type %q", hc.Type)
+}
+
+// sendExpect write Send and read until Expect is seen
+func (hc HealthCheck) sendExpect(target string) error {
+	conn, err := Dial("tcp", target, hc.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(hc.Timeout))
+	if len(hc.Send) > 0 {
+		if _, err = conn.Write([]byte(hc.Send)); err != nil {
+			return err
+		}
+	}
+	var reply []byte
+	var buffer = make([]byte, 4096)
+	for !bytes.Contains(reply, []byte(hc.Expect)) {
+		n, err := conn.Read(buffer)
+		reply = append(reply, buffer[:n]...)
+		if err != nil && !bytes.Contains(reply, []byte(hc.Expect)) {
+			return fmt.Errorf("expected %q got %q %v", hc.Expect, reply, err)
+		}
+	}
+	return nil
+}
+
+// health of one target, counting consecutive results toward rise and
+// fall
+type health struct {
+	up     bool
+	passes int
+	fails  int
+}
+
+// Health tracked per target of a ManagedListener
+type Health struct {
+	sync.RWMutex
+	targets map[string]*health
+	// bumped by reset, results from older checks are dropped
+	generation int
+}
+
+// Healthy reports if target should receive connections, targets not
+// checked yet are healthy
+func (h *Health) Healthy(target string) bool {
+	h.RLock()
+	defer h.RUnlock()
+	if state, ok := h.targets[target]; ok {
+		return state.up
+	}
+	return true
+}
+
+// Filter targets to the healthy ones
+func (h *Health) Filter(targets []string) (healthy []string) {
+	for _, target := range targets {
+		if h.Healthy(target) {
+			healthy = append(healthy, target)
+		}
+	}
+	return
+}
+
+// record a check result of generation for pipe's target, returns true
+// when the target changed state
+func (h *Health) record(pipe string, hc HealthCheck, generation int, target string, err error) (changed bool) {
+	h.Lock()
+	defer h.Unlock()
+	if generation != h.generation {
+		return false
+	}
+	if h.targets == nil {
+		h.targets = make(map[string]*health)
+	}
+	state, ok := h.targets[target]
+	if !ok {
+		state = &health{up: true}
+		h.targets[target] = state
+	}
+	if err == nil {
+		state.passes, state.fails = state.passes+1, 0
+		if !state.up && state.passes >= hc.Rise {
+			state.up, changed = true, true
+		}
+	} else {
+		state.passes, state.fails = 0, state.fails+1
+		if state.up && state.fails >= hc.Fall {
+			state.up, changed = false, true
+		}
+	}
+	// set with the lock held so a forgotten target's series stays gone
+	var up float64
+	if state.up {
+		up = 1
+	}
+	metrics.Healthy.WithLabelValues(pipe, target).Set(up)
+	return
+}
+
+// current generation of checks
+func (h *Health) current() int {
+	h.RLock()
+	defer h.RUnlock()
+	return h.generation
+}
+
+// reset every target of pipe to healthy and unchecked, for a changed
+// or removed health check
+func (h *Health) reset(pipe string) {
+	h.Lock()
+	defer h.Unlock()
+	for target := range h.targets {
+		metrics.Healthy.DeleteLabelValues(pipe, target)
+	}
+	h.targets = nil
+	h.generation++
+}
+
+// forget pipe's targets no longer configured
+func (h *Health) forget(pipe string, targets []string) {
+	h.Lock()
+	defer h.Unlock()
+	var keep = make(map[string]bool)
+	for _, target := range targets {
+		keep[target] = true
+	}
+	for target := range h.targets {
+		if !keep[target] {
+			delete(h.targets, target)
+			metrics.Healthy.DeleteLabelValues(pipe, target)
+		}
+	}
+}
+
+// Targets the sink or the current endpoints
+func (ml *ManagedListener) Targets() []string {
+	ml.epMutex.RLock()
+	defer ml.epMutex.RUnlock()
+	return ml.targets()
+}
+
+// targets with epMutex held
+func (ml *ManagedListener) targets() []string {
+	// Don't use k8s endpoint lookup if not in a k8s cluster
+	if ml.Kubernetes && ml.EnableEp && len(ml.Endpoints) > 0 {
+		return append([]string{}, ml.Endpoints...)
+	}
+	return []string{ml.Sink}
+}
+
+// HealthChecking check every target each interval until the listener
+// is closed or updated, udp sinks aren't checked
+func (ml *ManagedListener) HealthChecking() {
+	var definition, done = ml.watching()
+	if definition.HealthCheck == nil || definition.IsUDP() {
+		return
+	}
+	var hc = definition.HealthCheck.Defaults()
+	var generation = ml.Health.current()
+	var ticker = time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+	for {
+		var targets = ml.Targets()
+		ml.Health.forget(ml.Name, targets)
+		var wg sync.WaitGroup
+		for _, target := range targets {
+			wg.Add(1)
+			go func(target string) {
+				defer wg.Done()
+				err := hc.Check(target)
+				if ml.Health.record(ml.Name, hc, generation, target, err) {
+					slog.Info("health", "pipe", ml.Name, "endpoint", target, "healthy", ml.Health.Healthy(target), "err", err)
+				}
+			}(target)
+		}
+		wg.Wait()
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package listener
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidwalter0/forwarder/kubeconfig"
+	"github.com/davidwalter0/forwarder/metrics"
+)
+
+func TestHealthCheck(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer web.Close()
+	var webAddress = strings.TrimPrefix(web.URL, "http://")
+
+	var checks = []struct {
+		hc     HealthCheck
+		target string
+		pass   bool
+	}{
+		{HealthCheck{Type: "tcp"}, sink.Addr().String(), true},
+		{HealthCheck{Type: "tcp"}, dead(t), false},
+		{HealthCheck{Type: "send-expect", Send: "PING\r\n", Expect: "PING"}, sink.Addr().String(), true},
+		{HealthCheck{Type: "send-expect", Send: "PING\r\n", Expect: "PONG", Timeout: time.Millisecond * 100}, sink.Addr().String(), false},
+		{HealthCheck{Type: "http", Path: "/healthz"}, webAddress, true},
+		{HealthCheck{Type: "http", Path: "/missing"}, webAddress, false},
+	}
+	for _, check := range checks {
+		if err := check.hc.Defaults().Check(check.target); (err == nil) != check.pass {
+			t.Errorf("%+v %s expected pass %v got %v", check.hc, check.target, check.pass, err)
+		}
+	}
+}
+
+func TestHealthRiseFall(t *testing.T) {
+	var h Health
+	var hc = HealthCheck{Rise: 2, Fall: 2}.Defaults()
+	var fail = http.ErrHandlerTimeout
+	var steps = []struct {
+		err     error
+		healthy bool
+	}{
+		{nil, true}, {fail, true}, {fail, false}, {nil, false}, {fail, false}, {nil, false}, {nil, true},
+	}
+	for i, step := range steps {
+		h.record("health", hc, 0, "target", step.err)
+		if h.Healthy("target") != step.healthy {
+			t.Fatalf("step %d expected healthy %v", i, step.healthy)
+		}
+	}
+}
+
+func TestHealthSkipsUnhealthy(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+	var down = dead(t)
+
+	ml := NewManagedListener("health", &PipeDefinition{
+		Source:      "127.0.0.1:0",
+		EnableEp:    true,
+		HealthCheck: &HealthCheck{Interval: time.Millisecond * 10, Fall: 1},
+	}, kubeconfig.KubeConfig{Kubernetes: true})
+	ml.SetEndpoints([]string{down, sink.Addr().String()})
+	ml.Open()
+	defer ml.Close()
+
+	var deadline = time.Now().Add(time.Second * 5)
+	for ml.Health.Healthy(down) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never marked unhealthy", down)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	for i := 0; i < 4; i++ {
+		if sink := ml.NextEndPoint(nil); sink == down {
+			t.Fatalf("unhealthy endpoint %s chosen", sink)
+		}
+	}
+}
+
+// TestUpdateRemovesHealth targets marked down come back when the
+// health check is removed in place
+func TestUpdateRemovesHealth(t *testing.T) {
+	var down = dead(t)
+	var definition = &PipeDefinition{
+		Source:      "127.0.0.1:0",
+		Sink:        down,
+		HealthCheck: &HealthCheck{Interval: time.Millisecond * 10, Fall: 1},
+	}
+	ml := NewManagedListener("unchecked", definition, kubeconfig.KubeConfig{})
+	ml.Open()
+	defer ml.Close()
+
+	var deadline = time.Now().Add(time.Second * 5)
+	for ml.NextEndPoint(nil) == down {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never marked unhealthy", down)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	var unchecked = *definition
+	unchecked.HealthCheck = nil
+	if err := ml.Update(&unchecked); err != nil {
+		t.Fatal(err)
+	}
+	// long enough for a check in flight to have landed
+	time.Sleep(time.Millisecond * 50)
+	if sink := ml.NextEndPoint(nil); sink != down {
+		t.Errorf("expected %s without a health check got %q", down, sink)
+	}
+	if metrics.Healthy.DeleteLabelValues("unchecked", down) {
+		t.Errorf("expected the health series of %s removed", down)
+	}
+}
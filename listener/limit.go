@@ -0,0 +1,95 @@
+package listener
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// QueueTimeout default bound on how long a queued connection waits for
+// a free slot
+var QueueTimeout = time.Second * 5
+
+// Limits counts a listener's connections, in total and by client host,
+// against the pipe's max-connections and max-connections-per-client
+type Limits struct {
+	mutex    sync.Mutex
+	total    int
+	clients  map[string]int
+	released chan bool
+}
+
+// NewLimits create empty connection counts
+func NewLimits() *Limits {
+	return &Limits{clients: make(map[string]int), released: make(chan bool)}
+}
+
+// LimitError a connection refused by a limit
+type LimitError struct {
+	Limit string
+	Max   int
+}
+
+// Error text naming the limit
+func (err *LimitError) Error() string {
+	return fmt.Sprintf("%s %d reached", err.Limit, err.Max)
+}
+
+// take a slot for client if both limits allow, with mutex held
+func (l *Limits) take(client string, max, perClient int) error {
+	if max > 0 && l.total >= max {
+		return &LimitError{Limit: "max-connections", Max: max}
+	}
+	if perClient > 0 && l.clients[client] >= perClient {
+		return &LimitError{Limit: "max-connections-per-client", Max: perClient}
+	}
+	l.total++
+	l.clients[client]++
+	return nil
+}
+
+// Acquire a slot for client, waiting up to wait for one to be released
+// when the limits are reached, or until done is closed. The error is
+// the limit that refused the connection.
+func (l *Limits) Acquire(client string, max, perClient int, wait time.Duration, done <-chan bool) error {
+	var timer *time.Timer
+	for {
+		l.mutex.Lock()
+		var err = l.take(client, max, perClient)
+		var released = l.released
+		l.mutex.Unlock()
+		if err == nil || wait <= 0 {
+			return err
+		}
+		if timer == nil {
+			timer = time.NewTimer(wait)
+			defer timer.Stop()
+		}
+		select {
+		case <-released:
+		case <-timer.C:
+			return err
+		case <-done:
+			return err
+		}
+	}
+}
+
+// Release client's slot, waking queued connections
+func (l *Limits) Release(client string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.total--
+	if l.clients[client]--; l.clients[client] <= 0 {
+		delete(l.clients, client)
+	}
+	close(l.released)
+	l.released = make(chan bool)
+}
+
+// Count of connections in total and for client
+func (l *Limits) Count(client string) (total, count int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.total, l.clients[client]
+}
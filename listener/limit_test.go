@@ -0,0 +1,110 @@
+package listener
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/davidwalter0/forwarder/kubeconfig"
+)
+
+func TestLimits(t *testing.T) {
+	var limits = NewLimits()
+	for i := 0; i < 2; i++ {
+		if err := limits.Acquire("a", 3, 2, 0, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err, ok := limits.Acquire("a", 3, 2, 0, nil).(*LimitError); !ok || err.Limit != "max-connections-per-client" {
+		t.Errorf("expected the per client limit got %v", err)
+	}
+	if err := limits.Acquire("b", 3, 2, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := limits.Acquire("c", 3, 2, 0, nil).(*LimitError); !ok || err.Limit != "max-connections" {
+		t.Errorf("expected the total limit got %v", err)
+	}
+
+	// a queued acquire takes the next released slot
+	var acquired = make(chan error)
+	go func() { acquired <- limits.Acquire("c", 3, 2, time.Second*5, nil) }()
+	time.Sleep(time.Millisecond * 100)
+	limits.Release("a")
+	if err := <-acquired; err != nil {
+		t.Fatalf("expected the queued connection admitted got %v", err)
+	}
+	if total, count := limits.Count("a"); total != 3 || count != 1 {
+		t.Errorf("expected 3 total and 1 for a got %d %d", total, count)
+	}
+
+	// and gives up after it's wait
+	var start = time.Now()
+	if err := limits.Acquire("d", 3, 2, time.Millisecond*200, nil); err == nil {
+		t.Error("expected the queued connection refused")
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*200 {
+		t.Errorf("gave up after %v", elapsed)
+	}
+}
+
+// open a connection through address and confirm it's piped, false when
+// the forwarder closed it
+func open(t *testing.T, address string) (net.Conn, bool) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	fmt.Fprint(conn, "ping")
+	var reply = make([]byte, 4)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		conn.Close()
+		return nil, false
+	}
+	return conn, true
+}
+
+func TestMaxConnections(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+
+	for _, overLimit := range []string{"reject", "queue"} {
+		ml := NewManagedListener("limited", &PipeDefinition{
+			Source:         "127.0.0.1:0",
+			Sink:           sink.Addr().String(),
+			MaxConnections: 2,
+			OverLimit:      overLimit,
+			QueueTimeout:   time.Second * 3,
+		}, kubeconfig.KubeConfig{})
+		ml.Open()
+		var source = ml.Listener.Addr().String()
+
+		first, ok := open(t, source)
+		if !ok {
+			t.Fatal("first connection refused")
+		}
+		second, ok := open(t, source)
+		if !ok {
+			t.Fatal("second connection refused")
+		}
+		defer second.Close()
+		if overLimit == "reject" {
+			if third, ok := open(t, source); ok {
+				third.Close()
+				t.Error("expected the third connection rejected")
+			}
+		} else {
+			time.AfterFunc(time.Millisecond*200, func() { first.Close() })
+			third, ok := open(t, source)
+			if !ok {
+				t.Error("expected the third connection queued until the first closed")
+			} else {
+				third.Close()
+			}
+		}
+		first.Close()
+		ml.Close()
+	}
+}
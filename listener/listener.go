@@ -1,20 +1,43 @@
 package listener
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/davidwalter0/forwarder/kubeconfig"
+	"github.com/davidwalter0/forwarder/metrics"
 	"github.com/davidwalter0/forwarder/tracer"
 	"github.com/davidwalter0/go-mutex"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
 )
 
 var retries = 3
 
+// DialAttempts max sinks tried for one connection before giving up
+var DialAttempts = 3
+
+// DialTimeout bound on each connection attempt to a sink
+var DialTimeout = time.Second * 5
+
+// HandshakeTimeout bound on a client's PROXY header and tls handshake
+var HandshakeTimeout = time.Second * 10
+
+// acceptBackoff pause after a failed accept on an open listener
+var acceptBackoff = time.Millisecond * 100
+
+// HalfCloseTimeout once one side has finished sending, how long the
+// other may stay quiet before the pipe is closed
+var HalfCloseTimeout = time.Second * 60
+
 // Listen open listener on address
 func Listen(address string) (listener net.Listener) {
 	var err error
@@ -22,7 +45,7 @@ func Listen(address string) (listener net.Listener) {
 	for i := 0; i < retries; i++ {
 		listener, err = net.Listen("tcp", address)
 		if err != nil {
-			log.Printf("net.Listen(\"tcp\", %s ) failed: %v\n", address, err)
+			slog.Error("listen failed", "source", address, "err", err)
 		} else {
 			return listener
 		}
@@ -32,23 +55,70 @@ func Listen(address string) (listener net.Listener) {
 
 // PipeDefinition maps source to sink
 type PipeDefinition struct {
-	Source    string   `json:"source"    help:"source ingress point host:port"`
-	Sink      string   `json:"sink"      help:"sink service point   host:port"`
-	Endpoints []string `json:"endpoints" help:"endpoints (sinks) k8s api / config"`
-	EnableEp  bool     `json:"enable-ep" help:"enable endpoints from service"`
-	Service   string   `json:"service"   help:"service name"`
-	Namespace string   `json:"namespace" help:"service namespace"`
+	Source              string          `json:"source"    help:"source ingress point host:port or unix:///path/to.sock"`
+	Sink                string          `json:"sink"      help:"sink service point   host:port or unix:///path/to.sock"`
+	Endpoints           []string        `json:"endpoints" help:"endpoints (sinks) k8s api / config"`
+	EnableEp            bool            `json:"enable-ep" help:"enable endpoints from service"`
+	Service             string          `json:"service"   help:"service name"`
+	Namespace           string          `json:"namespace" help:"service namespace"`
+	Protocol            string          `json:"protocol"  help:"tcp (default) or udp"`
+	Balance             string          `json:"balance"   help:"round-robin (default), least-connections, random-two-choices, weighted-round-robin or consistent-hash"`
+	Weights             map[string]int  `json:"weights"   help:"weighted-round-robin weight by endpoint host:port or host"`
+	HealthCheck         *HealthCheck    `json:"health"    yaml:"health" help:"active health check of the sink or endpoints"`
+	TLS                 *TLSConfig      `json:"tls"       help:"terminate tls on the source, forward plaintext to the sink"`
+	SNI                 string          `json:"sni"       help:"tls server name routed to this pipe when pipes share a source, *.domain wildcards and * catch all"`
+	ProxyProtocol       string          `json:"proxy-protocol" yaml:"proxy-protocol" help:"v1 or v2 PROXY protocol header sent to the sink with the client's address"`
+	AcceptProxyProtocol bool            `json:"accept-proxy-protocol" yaml:"accept-proxy-protocol" help:"clients send a v1 or v2 PROXY protocol header with the real client address"`
+	TrustedProxies      []string        `json:"trusted-proxies" yaml:"trusted-proxies" help:"CIDRs or addresses allowed to send PROXY headers, unset trusts any peer"`
+	ConnectTimeout      time.Duration   `json:"connect-timeout" yaml:"connect-timeout" help:"bound on each dial of a sink, DialTimeout when unset"`
+	IdleTimeout         time.Duration   `json:"idle-timeout" yaml:"idle-timeout" help:"close a pipe with no bytes in either direction for this long, unset never"`
+	MaxLifetime         time.Duration   `json:"max-lifetime" yaml:"max-lifetime" help:"close a pipe this long after it's accepted, unset never"`
+	MaxConnections      int             `json:"max-connections" yaml:"max-connections" help:"bound on the pipe's open connections, unset unbounded"`
+	MaxPerClient        int             `json:"max-connections-per-client" yaml:"max-connections-per-client" help:"bound on open connections from one client host, unset unbounded"`
+	OverLimit           string          `json:"over-limit" yaml:"over-limit" help:"reject (default) a connection over a limit, or queue it for queue-timeout"`
+	QueueTimeout        time.Duration   `json:"queue-timeout" yaml:"queue-timeout" help:"longest a queued connection waits for a slot, QueueTimeout when unset"`
+	Allow               []string        `json:"allow"     help:"client CIDRs or addresses allowed to connect, unset allows all"`
+	Deny                []string        `json:"deny"      help:"client CIDRs or addresses refused, checked before allow"`
+	Bandwidth           *Bandwidth      `json:"bandwidth" help:"bytes per second limits for the pipe and each client"`
+	ConnectionRate      *ConnectionRate `json:"connection-rate" yaml:"connection-rate" help:"new connections per second from each client host, with bans for repeat offenders"`
+	Socket              *Socket         `json:"socket"    help:"mode, owner and group of a unix:// source's socket"`
+}
+
+// IsUDP reports if the pipe forwards datagrams rather than streams
+func (pipe *PipeDefinition) IsUDP() bool {
+	return pipe.Protocol == "udp"
 }
 
 // NewPipeDefinition create and initialize a PipeDefinition
 func NewPipeDefinition(pipe *PipeDefinition) *PipeDefinition {
 	defer trace.Tracer.Detailed(trace.Detail).Enable(trace.Enabled).ScopedTrace()()
 	return &PipeDefinition{
-		Source:    pipe.Source,
-		Sink:      pipe.Sink,
-		EnableEp:  pipe.EnableEp,
-		Service:   pipe.Service,
-		Namespace: pipe.Namespace,
+		Source:              pipe.Source,
+		Sink:                pipe.Sink,
+		EnableEp:            pipe.EnableEp,
+		Service:             pipe.Service,
+		Namespace:           pipe.Namespace,
+		Protocol:            pipe.Protocol,
+		Balance:             pipe.Balance,
+		Weights:             pipe.Weights,
+		HealthCheck:         pipe.HealthCheck,
+		TLS:                 pipe.TLS,
+		SNI:                 pipe.SNI,
+		ProxyProtocol:       pipe.ProxyProtocol,
+		AcceptProxyProtocol: pipe.AcceptProxyProtocol,
+		TrustedProxies:      pipe.TrustedProxies,
+		ConnectTimeout:      pipe.ConnectTimeout,
+		IdleTimeout:         pipe.IdleTimeout,
+		MaxLifetime:         pipe.MaxLifetime,
+		MaxConnections:      pipe.MaxConnections,
+		MaxPerClient:        pipe.MaxPerClient,
+		OverLimit:           pipe.OverLimit,
+		QueueTimeout:        pipe.QueueTimeout,
+		Allow:               pipe.Allow,
+		Deny:                pipe.Deny,
+		Bandwidth:           pipe.Bandwidth,
+		ConnectionRate:      pipe.ConnectionRate,
+		Socket:              pipe.Socket,
 	}
 }
 
@@ -58,19 +128,38 @@ type PipeDefinitions map[string]*PipeDefinition
 // ManagedListener and it's dependent objects
 type ManagedListener struct {
 	PipeDefinition
-	Listener   net.Listener   `json:"-"`
-	Pipes      map[*Pipe]bool `json:"-"`
-	Mutex      mutex.Mutex    `json:"-"`
-	Wg         sync.WaitGroup `json:"-"`
-	Kubernetes bool           `json:"-"`
-	n          uint64
+	Name         string           `json:"name"`
+	Listener     net.Listener     `json:"-"`
+	PacketConn   net.PacketConn   `json:"-"`
+	Pipes        *Registry        `json:"-"`
+	Limits       *Limits          `json:"-"`
+	Flows        map[string]*Flow `json:"-"`
+	Mutex        mutex.Mutex      `json:"-"`
+	Wg           sync.WaitGroup   `json:"-"`
+	Kubernetes   bool             `json:"-"`
+	Balancer     Balancer         `json:"-"`
+	Health       Health           `json:"-"`
+	Certificates *Certificates    `json:"-"`
+	Done         chan bool        `json:"-"`
+	closeOnce    sync.Once
+	// epMutex guards the definition fields Update replaces, the
+	// Balancer and the Endpoints
+	epMutex sync.RWMutex
+	// watch closed when the definition's health checks and endpoint
+	// watch are replaced by Update or the listener stops
+	watch       chan bool
+	acl         *ACL
+	proxies     *ACL
+	throttle    *Throttle
+	rateLimiter *RateLimiter
 }
 
 // NewManagedListener create and populate a ManagedListener
-func NewManagedListener(pipe *PipeDefinition, kubeConfig kubeconfig.KubeConfig) *ManagedListener {
+func NewManagedListener(name string, pipe *PipeDefinition, kubeConfig kubeconfig.KubeConfig) *ManagedListener {
 	defer trace.Tracer.Detailed(trace.Detail).Enable(trace.Enabled).ScopedTrace()()
-	return &ManagedListener{
+	ml := &ManagedListener{
 		PipeDefinition: *pipe,
+		Name:           name,
 		// PipeDefinition: PipeDefinition{
 		// 	Source:    pipe.Source,
 		// 	Sink:      pipe.Sink,
@@ -78,11 +167,44 @@ func NewManagedListener(pipe *PipeDefinition, kubeConfig kubeconfig.KubeConfig)
 		// 	Service:   pipe.Service,
 		// 	Namespace: pipe.Namespace,
 		// },
-		Listener:   Listen(pipe.Source),
-		Pipes:      make(map[*Pipe]bool),
+		Pipes:      NewRegistry(),
+		Limits:     NewLimits(),
+		Flows:      make(map[string]*Flow),
 		Mutex:      mutex.Mutex{},
 		Kubernetes: kubeConfig.Kubernetes,
+		Done:       make(chan bool),
+		watch:      make(chan bool),
+	}
+	var err error
+	if ml.acl, err = NewACL(pipe.Allow, pipe.Deny); err != nil {
+		slog.Error("skipping allow and deny", "pipe", name, "err", err)
 	}
+	if ml.proxies, err = NewACL(pipe.TrustedProxies, nil); err != nil {
+		slog.Error("skipping trusted-proxies", "pipe", name, "err", err)
+	}
+	ml.throttle = NewThrottle(pipe.Bandwidth)
+	ml.rateLimiter = NewRateLimiter(pipe.ConnectionRate)
+	if ml.Balancer, err = NewBalancer(pipe.Balance, pipe.Weights); err != nil {
+		slog.Warn("using round-robin", "pipe", name, "err", err)
+		ml.Balancer = &RoundRobin{}
+	}
+	if pipe.IsUDP() {
+		ml.PacketConn = ListenPacket(pipe.Source)
+	} else if len(pipe.SNI) > 0 {
+		ml.Listener = ListenSNI(pipe.Source, pipe.SNI)
+	} else if path, ok := UnixPath(pipe.Source); ok {
+		ml.Listener = ListenUnix(path, pipe.Socket)
+	} else {
+		ml.Listener = Listen(pipe.Source)
+	}
+	if pipe.TLS != nil && ml.Listener != nil {
+		// never fall back to serving plaintext, handshakes fail until
+		// the watch loads the files
+		if ml.Certificates, err = NewCertificates(*pipe.TLS); err != nil {
+			slog.Error("tls failed, refusing handshakes until the files load", "pipe", name, "err", err)
+		}
+	}
+	return ml
 }
 
 // Monitor for this ManagedListener
@@ -91,65 +213,444 @@ func (ml *ManagedListener) Monitor() func() {
 	return ml.Mutex.Monitor()
 }
 
+// pipeID last id handed out to a Pipe
+var pipeID uint64
+
 // Pipe a connection initiated by the return from listen and the
 // up/down stream host:port pairs
 type Pipe struct {
+	ID         uint64
+	Name       string
 	SourceConn net.Conn
 	SinkConn   net.Conn
-	Pipes      *map[*Pipe]bool
-	Closed     bool
+	Sink       string
+	Start      time.Time
+	BytesIn    uint64
+	BytesOut   uint64
+	registry   *Registry
+	once       sync.Once
+	done       func()
+	finished   int32
+	// limiters for bytes in and out
+	in, out []*rate.Limiter
+	// last activity in unix nanoseconds
+	last        int64
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+	closed      chan bool
+	// why the pipe closed, set once
+	reason string
+}
+
+// NewPipe create a Pipe named for it's listener between an accepted
+// connection and it's sink, it's registered by Registry.Add
+func NewPipe(name string, SourceConn, SinkConn net.Conn, sink string) *Pipe {
+	metrics.Active.WithLabelValues(name).Inc()
+	return &Pipe{
+		ID:         atomic.AddUint64(&pipeID, 1),
+		Name:       name,
+		SourceConn: SourceConn,
+		SinkConn:   SinkConn,
+		Sink:       sink,
+		Start:      time.Now(),
+		last:       time.Now().UnixNano(),
+		closed:     make(chan bool),
+	}
+}
+
+// PipeStatus snapshot of a Pipe for reporting
+type PipeStatus struct {
+	ID       uint64    `json:"id"`
+	Client   string    `json:"client"`
+	Sink     string    `json:"sink"`
+	Start    time.Time `json:"start"`
+	BytesIn  uint64    `json:"bytes-in"`
+	BytesOut uint64    `json:"bytes-out"`
+}
+
+// Status of the pipe, bytes in are client to sink, bytes out are sink
+// to client
+func (p *Pipe) Status() PipeStatus {
+	return PipeStatus{
+		ID:       p.ID,
+		Client:   p.SourceConn.RemoteAddr().String(),
+		Sink:     p.Sink,
+		Start:    p.Start,
+		BytesIn:  atomic.LoadUint64(&p.BytesIn),
+		BytesOut: atomic.LoadUint64(&p.BytesOut),
+	}
+}
+
+// counter writer adding the bytes written to n and the metric
+type counter struct {
+	io.Writer
+	n      *uint64
+	metric prometheus.Counter
+}
+
+// Write and count
+func (c counter) Write(b []byte) (n int, err error) {
+	n, err = c.Writer.Write(b)
+	atomic.AddUint64(c.n, uint64(n))
+	c.metric.Add(float64(n))
+	return
 }
 
-// Open a link between source and sink
+// Open a link between source and sink, closed at MaxLifetime when set
 func (p *Pipe) Connect() {
-	defer trace.Tracer.Enable(trace.Enabled).ScopedTrace(fmt.Sprintf("Pipe: %v", *p))()
-	go func() {
-		defer trace.Tracer.Enable(trace.Enabled).ScopedTrace()()
-		var err error
-		defer p.Close()
-		if _, err = io.Copy(p.SinkConn, p.SourceConn); err != nil {
-			log.Printf("Connection failed: %v\n", err)
+	defer trace.Tracer.Enable(trace.Enabled).ScopedTrace(fmt.Sprintf("Pipe: %v", p.ID))()
+	var sink, source io.Writer = p.SinkConn, p.SourceConn
+	if len(p.in) > 0 || len(p.out) > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-p.closed
+			cancel()
+		}()
+		sink, source = throttled{sink, ctx, p.in}, throttled{source, ctx, p.out}
+	}
+	go p.copy(counter{sink, &p.BytesIn, metrics.Bytes.WithLabelValues(p.Name, "in")}, p.SourceConn, p.SinkConn)
+	go p.copy(counter{source, &p.BytesOut, metrics.Bytes.WithLabelValues(p.Name, "out")}, p.SinkConn, p.SourceConn)
+	if p.MaxLifetime > 0 {
+		go func() {
+			var timer = time.NewTimer(p.MaxLifetime)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				slog.Info("connection closed", "pipe", p.Name, "id", p.ID, "reason", "max-lifetime", "timeout", p.MaxLifetime)
+				p.close("max-lifetime")
+			case <-p.closed:
+			}
+		}()
+	}
+}
+
+// copy one direction of the pipe from src to dst, at EOF dst's write
+// side is shut so the peer sees the EOF while the other direction
+// carries on, the pipe closes when both are done
+func (p *Pipe) copy(w io.Writer, src, dst net.Conn) {
+	defer trace.Tracer.Enable(trace.Enabled).ScopedTrace()()
+	_, err := io.Copy(w, timed{Conn: src, pipe: p})
+	if err != nil {
+		var reason = "error"
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			reason = p.timedOut()
+		} else if errors.Is(err, net.ErrClosed) {
+			reason = "closed"
+		} else {
+			slog.Warn("connection failed", "pipe", p.Name, "id", p.ID, "client", p.SourceConn.RemoteAddr(), "sink", p.Sink, "err", err)
 		}
-	}()
-	go func() {
-		defer trace.Tracer.Enable(trace.Enabled).ScopedTrace()()
-		var err error
-		defer p.Close()
-		if _, err = io.Copy(p.SourceConn, p.SinkConn); err != nil {
-			log.Printf("Connection failed: %v\n", err)
+		p.close(reason)
+		return
+	}
+	if atomic.AddInt32(&p.finished, 1) == 2 || CloseWrite(dst) != nil {
+		p.close("eof")
+		return
+	}
+	// the other direction's read is already waiting
+	dst.SetReadDeadline(p.deadline())
+}
+
+// timeout quiet period allowed before the pipe closes, the lesser of
+// IdleTimeout and, once one direction has finished, HalfCloseTimeout
+func (p *Pipe) timeout() (timeout time.Duration) {
+	timeout = p.IdleTimeout
+	if atomic.LoadInt32(&p.finished) > 0 && (timeout == 0 || HalfCloseTimeout < timeout) {
+		timeout = HalfCloseTimeout
+	}
+	return
+}
+
+// timedOut reason for a read timing out, half-close-timeout when it's
+// HalfCloseTimeout that expired rather than IdleTimeout
+func (p *Pipe) timedOut() string {
+	if timeout := p.timeout(); timeout > 0 && timeout != p.IdleTimeout {
+		return "half-close-timeout"
+	}
+	return "idle"
+}
+
+// deadline for reads given the last activity in either direction, the
+// zero time when there's no timeout
+func (p *Pipe) deadline() time.Time {
+	if timeout := p.timeout(); timeout > 0 {
+		return time.Unix(0, atomic.LoadInt64(&p.last)).Add(timeout)
+	}
+	return time.Time{}
+}
+
+// timed reader enforcing the pipe's timeout, a read timing out while
+// the other direction was active waits on
+type timed struct {
+	net.Conn
+	pipe *Pipe
+}
+
+// Read with the pipe's deadline
+func (r timed) Read(b []byte) (int, error) {
+	for {
+		r.Conn.SetReadDeadline(r.pipe.deadline())
+		n, err := r.Conn.Read(b)
+		if n > 0 {
+			atomic.StoreInt64(&r.pipe.last, time.Now().UnixNano())
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && n == 0 {
+			if deadline := r.pipe.deadline(); !deadline.IsZero() && time.Now().Before(deadline) {
+				continue
+			}
+			slog.Info("connection closed", "pipe", r.pipe.Name, "id", r.pipe.ID, "reason", r.pipe.timedOut(), "timeout", r.pipe.timeout())
 		}
-	}()
+		return n, err
+	}
+}
+
+// closeWriter connections that can shut down their write side
+type closeWriter interface {
+	CloseWrite() error
 }
 
-// Close a link between source and sink
+// CloseWrite shut down conn's write side, an error when conn can't
+// half close
+func CloseWrite(conn net.Conn) error {
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return fmt.Errorf("%T can't half close", conn)
+}
+
+// Close a link between source and sink, safe to call more than once
+// and from either copy goroutine
 func (p *Pipe) Close() {
+	p.close("closed")
+}
+
+// close the pipe recording reason in the access log, the first
+// reason wins
+func (p *Pipe) close(reason string) {
 	defer trace.Tracer.Enable(trace.Enabled).ScopedTrace()()
-	p.SourceConn.Close()
-	p.SinkConn.Close()
-	pipe := *p
-	delete(*pipe.Pipes, p)
+	p.once.Do(func() {
+		p.reason = reason
+		close(p.closed)
+		if p.registry != nil {
+			p.registry.Remove(p)
+		}
+		p.SourceConn.Close()
+		p.SinkConn.Close()
+		if p.done != nil {
+			p.done()
+		}
+		metrics.Active.WithLabelValues(p.Name).Dec()
+		metrics.Duration.WithLabelValues(p.Name).Observe(time.Since(p.Start).Seconds())
+		Access.Log(p.Record())
+	})
+}
+
+// Record of the pipe for the access log
+func (p *Pipe) Record() AccessRecord {
+	var end = time.Now()
+	return AccessRecord{
+		Pipe:     p.Name,
+		ID:       p.ID,
+		Client:   p.SourceConn.RemoteAddr().String(),
+		Sink:     p.Sink,
+		Start:    p.Start,
+		End:      end,
+		Duration: end.Sub(p.Start).Seconds(),
+		BytesIn:  atomic.LoadUint64(&p.BytesIn),
+		BytesOut: atomic.LoadUint64(&p.BytesOut),
+		Reason:   p.reason,
+	}
 }
 
 // Open listener for this endPtDef
 func (ml *ManagedListener) Open() {
 	defer trace.Tracer.Enable(trace.Enabled).ScopedTrace()()
 	go ml.Listening()
+	go ml.HealthChecking()
+	if ml.Certificates != nil {
+		go ml.Certificates.Watch(ml.Done)
+	}
 }
 
-// NextEndPoint returns the next host:port pair if more than one available
-// round robin selection
-func (ml *ManagedListener) NextEndPoint() (sink string) {
-	var n uint64
-	// Don't use k8s endpoint lookup if not in a k8s cluster
-	if ml.Kubernetes && ml.EnableEp && len(ml.Endpoints) > 0 {
-		n = atomic.AddUint64(&ml.n, 1) % uint64(len(ml.Endpoints))
-		sink = ml.Endpoints[n]
-	} else {
-		sink = ml.Sink
+// NextEndPoint returns the host:port pair for client's next
+// connection chosen by the listener's Balancer from the healthy
+// targets, empty when none are healthy
+func (ml *ManagedListener) NextEndPoint(client net.Addr) (sink string) {
+	return ml.next(ml.balancer(), client, nil)
+}
+
+// next endpoint for client chosen by balancer from the healthy targets
+// not already tried
+func (ml *ManagedListener) next(balancer Balancer, client net.Addr, tried map[string]bool) (sink string) {
+	var targets []string
+	for _, target := range ml.Health.Filter(ml.Targets()) {
+		if !tried[target] {
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) > 0 {
+		sink = balancer.Next(client, targets)
 	}
 	return
 }
 
+// throttler bandwidth limits for new connections
+func (ml *ManagedListener) throttler() *Throttle {
+	ml.epMutex.RLock()
+	defer ml.epMutex.RUnlock()
+	return ml.throttle
+}
+
+// balancer choosing sinks for new connections
+func (ml *ManagedListener) balancer() Balancer {
+	ml.epMutex.RLock()
+	defer ml.epMutex.RUnlock()
+	return ml.Balancer
+}
+
+// Definition copy of the listener's current pipe definition
+func (ml *ManagedListener) Definition() PipeDefinition {
+	ml.epMutex.RLock()
+	defer ml.epMutex.RUnlock()
+	return ml.PipeDefinition
+}
+
+// watching the current definition and the channel closed when it's
+// replaced or the listener stops
+func (ml *ManagedListener) watching() (PipeDefinition, <-chan bool) {
+	ml.epMutex.RLock()
+	defer ml.epMutex.RUnlock()
+	return ml.PipeDefinition, ml.watch
+}
+
+// Update the listener to pipe without rebinding it's source, active
+// pipes keep their sink and new connections use the new definition.
+// Fails when pipe binds differently or the listener is closed.
+func (ml *ManagedListener) Update(pipe *PipeDefinition) error {
+	if !ml.PipeDefinition.BindEqual(pipe) {
+		return fmt.Errorf("%s %s needs a rebind", ml.Name, pipe.Source)
+	}
+	acl, err := NewACL(pipe.Allow, pipe.Deny)
+	if err != nil {
+		slog.Error("skipping allow and deny", "pipe", ml.Name, "err", err)
+	}
+	proxies, err := NewACL(pipe.TrustedProxies, nil)
+	if err != nil {
+		slog.Error("skipping trusted-proxies", "pipe", ml.Name, "err", err)
+	}
+	ml.epMutex.Lock()
+	defer ml.epMutex.Unlock()
+	select {
+	case <-ml.Done:
+		return fmt.Errorf("%s closed", ml.Name)
+	default:
+	}
+	if ml.Balance != pipe.Balance || !WeightsEqual(ml.Weights, pipe.Weights) {
+		// a fresh balancer, active pipes finish on the one they used
+		balancer, err := NewBalancer(pipe.Balance, pipe.Weights)
+		if err != nil {
+			return err
+		}
+		ml.Balancer = balancer
+	}
+	if !BandwidthEqual(ml.Bandwidth, pipe.Bandwidth) {
+		// fresh buckets, active pipes keep the ones they started with
+		ml.throttle = NewThrottle(pipe.Bandwidth)
+	}
+	if !ConnectionRateEqual(ml.ConnectionRate, pipe.ConnectionRate) {
+		ml.rateLimiter = NewRateLimiter(pipe.ConnectionRate)
+	}
+	var targets = ml.targets()
+	var service = ml.EnableEp != pipe.EnableEp || ml.Service != pipe.Service || ml.Namespace != pipe.Namespace
+	var checks = !HealthEqual(ml.HealthCheck, pipe.HealthCheck)
+	var restart = service || checks
+	if checks {
+		// targets marked down by the old check start over
+		ml.Health.reset(ml.Name)
+	}
+	// the bind fields are equal and read unlocked, leave them be
+	ml.Sink = pipe.Sink
+	ml.EnableEp = pipe.EnableEp
+	ml.Service = pipe.Service
+	ml.Namespace = pipe.Namespace
+	ml.Balance = pipe.Balance
+	ml.Weights = pipe.Weights
+	ml.HealthCheck = pipe.HealthCheck
+	ml.ProxyProtocol = pipe.ProxyProtocol
+	ml.AcceptProxyProtocol = pipe.AcceptProxyProtocol
+	ml.TrustedProxies = pipe.TrustedProxies
+	ml.proxies = proxies
+	ml.ConnectTimeout = pipe.ConnectTimeout
+	ml.IdleTimeout = pipe.IdleTimeout
+	ml.MaxLifetime = pipe.MaxLifetime
+	ml.MaxConnections = pipe.MaxConnections
+	ml.MaxPerClient = pipe.MaxPerClient
+	ml.OverLimit = pipe.OverLimit
+	ml.QueueTimeout = pipe.QueueTimeout
+	ml.Allow = pipe.Allow
+	ml.Deny = pipe.Deny
+	ml.acl = acl
+	ml.Bandwidth = pipe.Bandwidth
+	ml.ConnectionRate = pipe.ConnectionRate
+	if service {
+		ml.setEndpoints(nil)
+	}
+	forgetSinks(ml.Name, targets, ml.targets())
+	if restart {
+		close(ml.watch)
+		ml.watch = make(chan bool)
+		go ml.HealthChecking()
+		go ml.WatchEndpoints()
+	}
+	slog.Info("updated", "pipe", ml.Name, "source", ml.Source, "sink", ml.Sink, "service", ml.Service, "namespace", ml.Namespace)
+	return nil
+}
+
+// SetEndpoints replace the service's endpoints used by NextEndPoint
+func (ml *ManagedListener) SetEndpoints(endpoints []string) {
+	ml.epMutex.Lock()
+	defer ml.epMutex.Unlock()
+	ml.setEndpoints(endpoints)
+}
+
+// setEndpoints with epMutex held
+func (ml *ManagedListener) setEndpoints(endpoints []string) {
+	slog.Info("endpoints", "pipe", ml.Name, "service", ml.Service, "namespace", ml.Namespace, "endpoints", endpoints, "source", ml.Source)
+	var targets = ml.targets()
+	ml.Endpoints = endpoints
+	forgetSinks(ml.Name, targets, ml.targets())
+	metrics.Endpoints.WithLabelValues(ml.Name).Set(float64(len(endpoints)))
+}
+
+// forgetSinks drop pipe's dial failure series of the old targets that
+// aren't current
+func forgetSinks(pipe string, old, current []string) {
+	var keep = make(map[string]bool)
+	for _, target := range current {
+		keep[target] = true
+	}
+	for _, target := range old {
+		if !keep[target] {
+			metrics.DialFailures.DeleteLabelValues(pipe, target)
+		}
+	}
+}
+
+// WatchEndpoints keep the endpoints current with the service until the
+// listener is closed or updated to another service
+func (ml *ManagedListener) WatchEndpoints() {
+	var definition, done = ml.watching()
+	if ml.Kubernetes && definition.EnableEp {
+		kubeconfig.WatchEndpoints(definition.Service, definition.Namespace, func(endpoints []string) {
+			ml.epMutex.Lock()
+			defer ml.epMutex.Unlock()
+			// ignore a replaced watch still delivering
+			if ml.watch == done {
+				ml.setEndpoints(endpoints)
+			}
+		}, done)
+	}
+}
+
 // Accept expose ManagedListener's listener
 func (ml *ManagedListener) Accept() (net.Conn, error) {
 	// defer trace.Tracer.Enable(trace.Enabled).ScopedTrace()()
@@ -159,34 +660,343 @@ func (ml *ManagedListener) Accept() (net.Conn, error) {
 // Listening on managed listener
 func (ml *ManagedListener) Listening() {
 	// defer trace.Tracer.Detailed(trace.Detail).Enable(trace.Enabled).ScopedTrace(fmt.Sprintf("listener:\n%v\n", kubeconfig.Yamlify(ml.PipeDefinition)))()
-	// log.Println(kubeconfig.Yamlify(ml.PipeDefinition))
+	if ml.IsUDP() {
+		ml.ListeningUDP()
+		return
+	}
+	if ml.Listener == nil {
+		slog.Error("no listener", "pipe", ml.Name, "source", ml.Source)
+		return
+	}
 	for {
 		var err error
-		var SourceConn, SinkConn net.Conn
+		var SourceConn net.Conn
 		// defer trace.Tracer.Detailed(trace.Detail).Enable(trace.Enabled).ScopedTrace(fmt.Sprintf("listener:%v", ml))()
 		if SourceConn, err = ml.Accept(); err != nil {
-			log.Printf("Connection failed: %v\n", err)
-			break
+			select {
+			case <-ml.Done:
+				return
+			default:
+			}
+			// e.g. out of file descriptors, back off and keep accepting
+			slog.Warn("accept failed", "pipe", ml.Name, "err", err)
+			time.Sleep(acceptBackoff)
+			continue
 		}
-		sink := ml.NextEndPoint()
-		SinkConn, err = net.Dial("tcp", sink)
+		metrics.Accepted.WithLabelValues(ml.Name).Inc()
+		// a PROXY header's client is checked once it's read in Serve,
+		// the peer sending it must be a trusted proxy
+		if ml.Definition().AcceptProxyProtocol {
+			if !ml.Trusted(SourceConn.RemoteAddr()) {
+				slog.Info("connection refused", "pipe", ml.Name, "client", SourceConn.RemoteAddr(), "err", "untrusted proxy")
+				SourceConn.Close()
+				continue
+			}
+		} else if err = ml.Screen(SourceConn.RemoteAddr()); err != nil {
+			slog.Info("connection refused", "pipe", ml.Name, "client", SourceConn.RemoteAddr(), "err", err)
+			SourceConn.Close()
+			continue
+		}
+		go ml.Serve(SourceConn)
+	}
+}
+
+// Serve an accepted connection, dial a sink and pipe between them
+func (ml *ManagedListener) Serve(SourceConn net.Conn) {
+	var definition = ml.Definition()
+	// the PROXY header comes first, ahead of any tls handshake
+	if definition.AcceptProxyProtocol {
+		conn, err := AcceptProxyHeader(SourceConn, HandshakeTimeout)
 		if err != nil {
-			log.Printf("Connection failed: %v\n", err)
-			break
+			slog.Warn("connection failed", "pipe", ml.Name, "client", SourceConn.RemoteAddr(), "err", err)
+			SourceConn.Close()
+			return
+		}
+		if err = ml.Screen(conn.RemoteAddr()); err != nil {
+			slog.Info("connection refused", "pipe", ml.Name, "client", conn.RemoteAddr(), "via", SourceConn.RemoteAddr(), "err", err)
+			SourceConn.Close()
+			return
 		}
-		pipe := &Pipe{SourceConn: SourceConn, SinkConn: SinkConn, Pipes: &ml.Pipes}
-		ml.Pipes[pipe] = true
-		go pipe.Connect()
+		SourceConn = conn
 	}
+	// limits count the client from the PROXY header
+	var client = host(SourceConn.RemoteAddr().String())
+	if err := ml.Limit(definition, client); err != nil {
+		slog.Info("connection refused", "pipe", ml.Name, "client", SourceConn.RemoteAddr(), "err", err)
+		SourceConn.Close()
+		return
+	}
+	var release = func() { ml.Limits.Release(client) }
+	if ml.Certificates != nil {
+		conn := tls.Server(SourceConn, ml.Certificates.Config())
+		conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+		if err := conn.Handshake(); err != nil {
+			slog.Warn("tls handshake failed", "pipe", ml.Name, "client", SourceConn.RemoteAddr(), "err", err)
+			SourceConn.Close()
+			release()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		SourceConn = conn
+	}
+	SinkConn, sink, balancer, err := ml.dial(SourceConn.RemoteAddr())
+	if err != nil {
+		slog.Warn("no endpoint reachable", "pipe", ml.Name, "client", SourceConn.RemoteAddr(), "err", err)
+		SourceConn.Close()
+		release()
+		return
+	}
+	if len(definition.ProxyProtocol) > 0 {
+		if err = WriteProxyHeader(SinkConn, definition.ProxyProtocol, SourceConn.RemoteAddr(), SourceConn.LocalAddr()); err != nil {
+			slog.Warn("proxy-protocol failed", "pipe", ml.Name, "client", SourceConn.RemoteAddr(), "sink", sink, "err", err)
+			balancer.Done(sink)
+			SourceConn.Close()
+			SinkConn.Close()
+			release()
+			return
+		}
+	}
+	pipe := NewPipe(ml.Name, SourceConn, SinkConn, sink)
+	var throttle = ml.throttler()
+	pipe.in, pipe.out = throttle.Acquire(client)
+	pipe.done = func() {
+		balancer.Done(sink)
+		throttle.Release(client)
+		release()
+	}
+	pipe.IdleTimeout, pipe.MaxLifetime = definition.IdleTimeout, definition.MaxLifetime
+	select {
+	case <-ml.Done:
+		// stopped while dialing
+		pipe.Close()
+		return
+	default:
+	}
+	if !ml.Pipes.Add(pipe) {
+		pipe.Close()
+		return
+	}
+	go pipe.Connect()
+}
+
+// Admit reports if the pipe's allow and deny lists let client connect,
+// refusals are counted
+func (ml *ManagedListener) Admit(client net.Addr) bool {
+	ml.epMutex.RLock()
+	var acl = ml.acl
+	ml.epMutex.RUnlock()
+	if acl.Allowed(client) {
+		return true
+	}
+	metrics.Rejected.WithLabelValues(ml.Name, "denied").Inc()
+	return false
+}
+
+// Trusted reports if peer may send a PROXY header, refusals are
+// counted
+func (ml *ManagedListener) Trusted(peer net.Addr) bool {
+	ml.epMutex.RLock()
+	var proxies = ml.proxies
+	ml.epMutex.RUnlock()
+	if proxies.Allowed(peer) {
+		return true
+	}
+	metrics.Rejected.WithLabelValues(ml.Name, "untrusted-proxy").Inc()
+	return false
+}
+
+// Screen a new tcp client against the allow and deny lists and the
+// connection rate
+func (ml *ManagedListener) Screen(client net.Addr) error {
+	if !ml.Admit(client) {
+		return fmt.Errorf("denied")
+	}
+	ml.epMutex.RLock()
+	var limiter = ml.rateLimiter
+	ml.epMutex.RUnlock()
+	err := limiter.Allow(host(client.String()))
+	if re, ok := err.(*RateError); ok {
+		metrics.Rejected.WithLabelValues(ml.Name, re.Reason).Inc()
+	}
+	return err
+}
+
+// Limit take a connection slot for client under definition's limits,
+// queueing when over-limit is queue, the error names the limit reached
+func (ml *ManagedListener) Limit(definition PipeDefinition, client string) error {
+	var wait time.Duration
+	if definition.OverLimit == "queue" {
+		if wait = definition.QueueTimeout; wait <= 0 {
+			wait = QueueTimeout
+		}
+	}
+	err := ml.Limits.Acquire(client, definition.MaxConnections, definition.MaxPerClient, wait, ml.Done)
+	if le, ok := err.(*LimitError); ok {
+		metrics.Rejected.WithLabelValues(ml.Name, le.Limit).Inc()
+	}
+	return err
+}
+
+// Network of the pipe for net.Dial
+func (ml *ManagedListener) Network() string {
+	if ml.IsUDP() {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// Attempts bound on sinks to try for one connection, each endpoint at
+// most once up to DialAttempts
+func (ml *ManagedListener) Attempts() (attempts int) {
+	ml.epMutex.RLock()
+	attempts = len(ml.Endpoints)
+	ml.epMutex.RUnlock()
+	if attempts > DialAttempts {
+		attempts = DialAttempts
+	}
+	if attempts < 1 {
+		attempts = 1
+	}
+	return
+}
+
+// Dial the next endpoint for client, on failure move on to the
+// following endpoint until one answers or Attempts are exhausted
+func (ml *ManagedListener) Dial(client net.Addr) (conn net.Conn, sink string, err error) {
+	conn, sink, _, err = ml.dial(client)
+	return
+}
+
+// dial as Dial, also returning the balancer that chose sink
+func (ml *ManagedListener) dial(client net.Addr) (conn net.Conn, sink string, balancer Balancer, err error) {
+	balancer = ml.balancer()
+	var timeout = DialTimeout
+	if definition := ml.Definition(); definition.ConnectTimeout > 0 {
+		timeout = definition.ConnectTimeout
+	}
+	// each retry moves on to an endpoint this dial hasn't tried
+	var tried = make(map[string]bool)
+	for i, attempts := 0, ml.Attempts(); i < attempts; i++ {
+		if sink = ml.next(balancer, client, tried); len(sink) == 0 {
+			if i == 0 {
+				err = fmt.Errorf("%s no healthy endpoints", ml.Name)
+			}
+			return
+		}
+		tried[sink] = true
+		if conn, err = Dial(ml.Network(), sink, timeout); err == nil {
+			return
+		}
+		balancer.Done(sink)
+		metrics.DialFailures.WithLabelValues(ml.Name, sink).Inc()
+		slog.Warn("dial failed", "pipe", ml.Name, "endpoint", sink, "attempt", i+1, "attempts", attempts, "err", err)
+	}
+	return
+}
+
+// Bound reports if the listener is open on it's source
+func (ml *ManagedListener) Bound() bool {
+	select {
+	case <-ml.Done:
+		return false
+	default:
+		return ml.Listener != nil || ml.PacketConn != nil
+	}
+}
+
+// ListenerStatus snapshot of a ManagedListener for reporting
+type ListenerStatus struct {
+	Name      string   `json:"name"`
+	Source    string   `json:"source"`
+	Sink      string   `json:"sink"`
+	Service   string   `json:"service"`
+	Namespace string   `json:"namespace"`
+	Protocol  string   `json:"protocol"`
+	Balance   string   `json:"balance"`
+	TLS       bool     `json:"tls"`
+	SNI       string   `json:"sni"`
+	Endpoints []string `json:"endpoints"`
+	Bound     bool     `json:"bound"`
+	Pipes     int      `json:"pipes"`
+	Flows     int      `json:"flows"`
+	// Banned clients and when their bans end
+	Banned map[string]time.Time `json:"banned,omitempty"`
+}
+
+// Status of the listener
+func (ml *ManagedListener) Status() ListenerStatus {
+	var definition = ml.Definition()
+	ml.epMutex.RLock()
+	var limiter = ml.rateLimiter
+	ml.epMutex.RUnlock()
+	defer ml.Monitor()()
+	return ListenerStatus{
+		Name:      ml.Name,
+		Source:    definition.Source,
+		Sink:      definition.Sink,
+		Service:   definition.Service,
+		Namespace: definition.Namespace,
+		Protocol:  definition.Protocol,
+		Balance:   definition.Balance,
+		TLS:       ml.Certificates != nil,
+		SNI:       definition.SNI,
+		Endpoints: append([]string{}, definition.Endpoints...),
+		Bound:     ml.Bound(),
+		Pipes:     ml.Pipes.Len(),
+		Flows:     len(ml.Flows),
+		Banned:    limiter.Banned(),
+	}
+}
+
+// PipeStatus of each active pipe
+func (ml *ManagedListener) PipeStatus() (pipes []PipeStatus) {
+	for _, pipe := range ml.Pipes.Snapshot() {
+		pipes = append(pipes, pipe.Status())
+	}
+	return
+}
+
+// ClosePipe by id, reports if the pipe was found
+func (ml *ManagedListener) ClosePipe(id uint64) bool {
+	if pipe := ml.Pipes.Get(id); pipe != nil {
+		pipe.close("admin")
+		return true
+	}
+	return false
+}
+
+// Stop accepting on the source, active pipes are left to finish, udp
+// flows end with the source socket
+func (ml *ManagedListener) Stop() {
+	ml.closeOnce.Do(func() {
+		close(ml.Done)
+		ml.epMutex.Lock()
+		close(ml.watch)
+		ml.epMutex.Unlock()
+		if ml.PacketConn != nil {
+			if err := ml.PacketConn.Close(); err != nil {
+				slog.Warn("closing listener failed", "pipe", ml.Name, "source", ml.Source, "err", err)
+			}
+		}
+		if ml.Listener != nil {
+			if err := ml.Listener.Close(); err != nil {
+				slog.Warn("closing listener failed", "pipe", ml.Name, "source", ml.Source, "err", err)
+			}
+		}
+	})
+}
+
+// Active number of open pipes
+func (ml *ManagedListener) Active() int {
+	return ml.Pipes.Len()
 }
 
 // Close a listener and it's children
 func (ml *ManagedListener) Close() {
-	if err := ml.Listener.Close(); err != nil {
-		log.Println("Error closing listener", ml.Listener)
-	}
+	ml.Stop()
+	ml.Pipes.Close()
 	defer ml.Monitor()()
-	for pipe := range ml.Pipes {
-		pipe.Close()
+	for _, flow := range ml.Flows {
+		flow.Close()
 	}
 }
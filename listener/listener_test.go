@@ -0,0 +1,456 @@
+package listener
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/davidwalter0/forwarder/kubeconfig"
+	"github.com/davidwalter0/forwarder/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// echo server copying every connection back to itself
+func echo(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				io.Copy(conn, conn)
+				conn.Close()
+			}(conn)
+		}
+	}()
+	return l
+}
+
+// dead address with nothing listening
+func dead(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// roundTrip a message through address
+func roundTrip(t *testing.T, address, message string) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	fmt.Fprint(conn, message)
+	var buffer = make([]byte, len(message))
+	if _, err = io.ReadFull(conn, buffer); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buffer); got != message {
+		t.Fatalf("Unexpected message:\nGot:\t\t%s\nExpected:\t%s\n", got, message)
+	}
+}
+
+func TestDialFailover(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+
+	ml := NewManagedListener("failover", &PipeDefinition{
+		Source:   "127.0.0.1:0",
+		EnableEp: true,
+	}, kubeconfig.KubeConfig{Kubernetes: true})
+	ml.SetEndpoints([]string{dead(t), sink.Addr().String(), dead(t)})
+	ml.Open()
+	defer ml.Close()
+
+	// every connection lands on the live endpoint and the listener keeps
+	// accepting after dead endpoints
+	for i := 0; i < 6; i++ {
+		roundTrip(t, ml.Listener.Addr().String(), fmt.Sprintf("message %d", i))
+	}
+}
+
+// TestDialFailoverBalancers every balancer moves on from a dead
+// endpoint rather than choosing it again
+func TestDialFailoverBalancers(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+	var endpoints = []string{dead(t), sink.Addr().String()}
+	for name := range Balancers {
+		ml := NewManagedListener("failover", &PipeDefinition{
+			Source:   "127.0.0.1:0",
+			EnableEp: true,
+			Balance:  name,
+		}, kubeconfig.KubeConfig{Kubernetes: true})
+		ml.SetEndpoints(endpoints)
+		for i := 0; i < 20; i++ {
+			conn, connected, err := ml.Dial(tcp(fmt.Sprintf("10.0.0.%d:4000", i)))
+			if err != nil {
+				t.Errorf("%s dial %d failed %v", name, i, err)
+				continue
+			}
+			conn.Close()
+			if connected != endpoints[1] {
+				t.Errorf("%s dial %d connected to %s", name, i, connected)
+			}
+		}
+		ml.Close()
+	}
+}
+
+func TestDialAllFail(t *testing.T) {
+	ml := NewManagedListener("dead", &PipeDefinition{
+		Source: "127.0.0.1:0",
+		Sink:   dead(t),
+	}, kubeconfig.KubeConfig{})
+	ml.Open()
+	defer ml.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ml.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected client closed got %v", err)
+		}
+		conn.Close()
+	}
+}
+
+// greeter server answering every connection with name then echoing
+func greeter(t *testing.T, name string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprint(conn, name)
+			go func(conn net.Conn) {
+				io.Copy(conn, conn)
+				conn.Close()
+			}(conn)
+		}
+	}()
+	return l
+}
+
+// greeted dial address and read the sink's name
+func greeted(t *testing.T, address string) (net.Conn, string) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	var name = make([]byte, 1)
+	if _, err = io.ReadFull(conn, name); err != nil {
+		t.Fatal(err)
+	}
+	return conn, string(name)
+}
+
+// TestUpdate a sink change leaves the source bound and active pipes on
+// the old sink, new connections go to the new sink
+func TestUpdate(t *testing.T) {
+	a, b := greeter(t, "a"), greeter(t, "b")
+	defer a.Close()
+	defer b.Close()
+
+	ml := NewManagedListener("update", &PipeDefinition{Source: "127.0.0.1:0", Sink: a.Addr().String()}, kubeconfig.KubeConfig{})
+	ml.Open()
+	defer ml.Close()
+	var source = ml.Listener.Addr().String()
+
+	active, name := greeted(t, source)
+	defer active.Close()
+	if name != "a" {
+		t.Fatalf("expected a got %s", name)
+	}
+
+	if err := ml.Update(&PipeDefinition{Source: "127.0.0.1:0", Sink: b.Addr().String(), Balance: "least-connections"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ml.Balancer.(*LeastConnections); !ok {
+		t.Errorf("expected the balancer replaced got %T", ml.Balancer)
+	}
+	if status := ml.Status(); status.Sink != b.Addr().String() || status.Pipes != 1 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	updated, name := greeted(t, source)
+	updated.Close()
+	if name != "b" {
+		t.Fatalf("expected b after update got %s", name)
+	}
+	fmt.Fprint(active, "ping")
+	var reply = make([]byte, 4)
+	if _, err := io.ReadFull(active, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("expected the active pipe to survive the update %q %v", reply, err)
+	}
+
+	if err := ml.Update(&PipeDefinition{Source: dead(t), Sink: b.Addr().String()}); err == nil {
+		t.Error("expected a source change to need a rebind")
+	}
+	ml.Close()
+	if err := ml.Update(&PipeDefinition{Source: "127.0.0.1:0", Sink: a.Addr().String()}); err == nil {
+		t.Error("expected a closed listener to refuse updates")
+	}
+}
+
+// responder server reading each request to EOF before answering with
+// it's length and closing
+func responder(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				request, _ := ioutil.ReadAll(conn)
+				fmt.Fprintf(conn, "read %d", len(request))
+			}(conn)
+		}
+	}()
+	return l
+}
+
+// halfClose send request to address, shut the write side and read
+// the response
+func halfClose(t *testing.T, address string, header []byte, request string) string {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	conn.Write(header)
+	fmt.Fprint(conn, request)
+	conn.(*net.TCPConn).CloseWrite()
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(response)
+}
+
+// TestHalfClose a client shutting it's write side still gets the
+// response, directly and through the PROXY protocol wrapper
+func TestHalfClose(t *testing.T) {
+	sink := responder(t)
+	defer sink.Close()
+
+	for _, accept := range []bool{false, true} {
+		ml := NewManagedListener("half", &PipeDefinition{
+			Source:              "127.0.0.1:0",
+			Sink:                sink.Addr().String(),
+			AcceptProxyProtocol: accept,
+		}, kubeconfig.KubeConfig{})
+		ml.Open()
+		var header []byte
+		if accept {
+			header, _ = ProxyHeader("v1", tcp("203.0.113.7:51000"), tcp("198.51.100.1:443"))
+		}
+		if response := halfClose(t, ml.Listener.Addr().String(), header, "request"); response != "read 7" {
+			t.Errorf("accept-proxy-protocol %v expected read 7 got %q", accept, response)
+		}
+		ml.Close()
+	}
+}
+
+// TestHalfCloseTimeout a pipe left half closed is closed once the
+// other side is quiet for HalfCloseTimeout
+func TestHalfCloseTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { HalfCloseTimeout = timeout }(HalfCloseTimeout)
+	HalfCloseTimeout = time.Millisecond * 200
+
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	go func() {
+		// reads to EOF and never answers or closes
+		conn, err := sink.Accept()
+		if err == nil {
+			ioutil.ReadAll(conn)
+		}
+	}()
+	ml := NewManagedListener("quiet", &PipeDefinition{Source: "127.0.0.1:0", Sink: sink.Addr().String()}, kubeconfig.KubeConfig{})
+	ml.Open()
+	defer ml.Close()
+
+	var start = time.Now()
+	halfClose(t, ml.Listener.Addr().String(), nil, "request")
+	if elapsed := time.Since(start); elapsed > time.Second*3 {
+		t.Errorf("half closed pipe stayed open %v", elapsed)
+	}
+	if ml.Active() != 0 {
+		t.Errorf("expected the pipe closed got %d active", ml.Active())
+	}
+}
+
+// TestIdleTimeout a quiet pipe is closed, one busy in either direction
+// is left open
+func TestIdleTimeout(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+	ml := NewManagedListener("idle", &PipeDefinition{
+		Source:      "127.0.0.1:0",
+		Sink:        sink.Addr().String(),
+		IdleTimeout: time.Millisecond * 300,
+	}, kubeconfig.KubeConfig{})
+	ml.Open()
+	defer ml.Close()
+
+	conn, err := net.Dial("tcp", ml.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	var reply = make([]byte, 4)
+	// busy past the timeout
+	for i := 0; i < 6; i++ {
+		fmt.Fprint(conn, "ping")
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("busy pipe closed after %d round trips %v", i, err)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	var start = time.Now()
+	if _, err = conn.Read(reply); err == nil {
+		t.Fatal("expected the idle pipe closed")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*2 {
+		t.Errorf("idle pipe closed after %v", elapsed)
+	}
+}
+
+// TestMaxLifetime a busy pipe is closed at it's max-lifetime
+func TestMaxLifetime(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+	ml := NewManagedListener("lifetime", &PipeDefinition{
+		Source:      "127.0.0.1:0",
+		Sink:        sink.Addr().String(),
+		MaxLifetime: time.Millisecond * 300,
+	}, kubeconfig.KubeConfig{})
+	ml.Open()
+	defer ml.Close()
+
+	conn, err := net.Dial("tcp", ml.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	var start = time.Now()
+	var reply = make([]byte, 4)
+	for time.Since(start) < time.Second*5 {
+		fmt.Fprint(conn, "ping")
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if elapsed := time.Since(start); err == nil || elapsed < time.Millisecond*300 || elapsed > time.Second*2 {
+		t.Errorf("expected the pipe closed at it's max-lifetime after %v %v", elapsed, err)
+	}
+}
+
+// TestConnectTimeout a black holed sink fails within connect-timeout
+func TestConnectTimeout(t *testing.T) {
+	ml := NewManagedListener("blackhole", &PipeDefinition{
+		Source: "127.0.0.1:0",
+		// TEST-NET-1, never answers
+		Sink:           "192.0.2.1:9",
+		ConnectTimeout: time.Millisecond * 200,
+	}, kubeconfig.KubeConfig{})
+	defer ml.Close()
+	var start = time.Now()
+	if conn, _, err := ml.Dial(tcp("127.0.0.1:1")); err == nil {
+		conn.Close()
+		t.Skip("192.0.2.1 answered")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*2 {
+		t.Errorf("dial took %v", elapsed)
+	}
+}
+
+func TestForgetSinks(t *testing.T) {
+	metrics.DialFailures.WithLabelValues("forget", "a:1").Inc()
+	metrics.DialFailures.WithLabelValues("forget", "b:1").Inc()
+	forgetSinks("forget", []string{"a:1", "b:1"}, []string{"b:1", "c:1"})
+	if metrics.DialFailures.DeleteLabelValues("forget", "a:1") {
+		t.Error("expected the series of a removed sink dropped")
+	}
+	if !metrics.DialFailures.DeleteLabelValues("forget", "b:1") {
+		t.Error("expected the series of a current sink kept")
+	}
+}
+
+// settles waits for collector's value to reach expected, counters
+// move after the bytes they count are written
+func settles(t *testing.T, collector prometheus.Collector, expected float64) {
+	t.Helper()
+	var deadline = time.Now().Add(time.Second * 5)
+	for testutil.ToFloat64(collector) != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %v got %v", expected, testutil.ToFloat64(collector))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestPipeMetrics(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+	ml := NewManagedListener("metered", &PipeDefinition{
+		Source: "127.0.0.1:0",
+		Sink:   sink.Addr().String(),
+	}, kubeconfig.KubeConfig{})
+	ml.Open()
+	defer ml.Close()
+
+	var accepted = testutil.ToFloat64(metrics.Accepted.WithLabelValues("metered"))
+	client, err := net.Dial("tcp", ml.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetDeadline(time.Now().Add(time.Second * 5))
+	fmt.Fprint(client, "ping")
+	if _, err = io.ReadFull(client, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	settles(t, metrics.Accepted.WithLabelValues("metered"), accepted+1)
+	settles(t, metrics.Active.WithLabelValues("metered"), 1)
+	settles(t, metrics.Bytes.WithLabelValues("metered", "in"), 4)
+	settles(t, metrics.Bytes.WithLabelValues("metered", "out"), 4)
+
+	client.Close()
+	settles(t, metrics.Active.WithLabelValues("metered"), 0)
+}
@@ -1,6 +1,8 @@
 package listener
 
 import (
+	"strings"
+
 	"github.com/davidwalter0/forwarder/tracer"
 )
 
@@ -11,7 +13,28 @@ func (lhs *ManagedListener) Equal(rhs *ManagedListener) bool {
 		lhs.Sink == rhs.Sink &&
 		lhs.EnableEp == rhs.EnableEp &&
 		lhs.Service == rhs.Service &&
-		lhs.Namespace == rhs.Namespace
+		lhs.Namespace == rhs.Namespace &&
+		lhs.Protocol == rhs.Protocol &&
+		lhs.Balance == rhs.Balance &&
+		WeightsEqual(lhs.Weights, rhs.Weights) &&
+		HealthEqual(lhs.HealthCheck, rhs.HealthCheck) &&
+		TLSEqual(lhs.TLS, rhs.TLS) &&
+		lhs.SNI == rhs.SNI &&
+		lhs.ProxyProtocol == rhs.ProxyProtocol &&
+		lhs.AcceptProxyProtocol == rhs.AcceptProxyProtocol &&
+		StringsEqual(lhs.TrustedProxies, rhs.TrustedProxies) &&
+		lhs.ConnectTimeout == rhs.ConnectTimeout &&
+		lhs.IdleTimeout == rhs.IdleTimeout &&
+		lhs.MaxLifetime == rhs.MaxLifetime &&
+		lhs.MaxConnections == rhs.MaxConnections &&
+		lhs.MaxPerClient == rhs.MaxPerClient &&
+		lhs.OverLimit == rhs.OverLimit &&
+		lhs.QueueTimeout == rhs.QueueTimeout &&
+		StringsEqual(lhs.Allow, rhs.Allow) &&
+		StringsEqual(lhs.Deny, rhs.Deny) &&
+		BandwidthEqual(lhs.Bandwidth, rhs.Bandwidth) &&
+		ConnectionRateEqual(lhs.ConnectionRate, rhs.ConnectionRate) &&
+		SocketEqual(lhs.Socket, rhs.Socket)
 }
 
 // Copy points w/o erasing EndPoints
@@ -21,6 +44,27 @@ func (lhs *ManagedListener) Copy(rhs *ManagedListener) *ManagedListener {
 	lhs.EnableEp = rhs.EnableEp
 	lhs.Service = rhs.Service
 	lhs.Namespace = rhs.Namespace
+	lhs.Protocol = rhs.Protocol
+	lhs.Balance = rhs.Balance
+	lhs.Weights = rhs.Weights
+	lhs.HealthCheck = rhs.HealthCheck
+	lhs.TLS = rhs.TLS
+	lhs.SNI = rhs.SNI
+	lhs.ProxyProtocol = rhs.ProxyProtocol
+	lhs.AcceptProxyProtocol = rhs.AcceptProxyProtocol
+	lhs.TrustedProxies = rhs.TrustedProxies
+	lhs.ConnectTimeout = rhs.ConnectTimeout
+	lhs.IdleTimeout = rhs.IdleTimeout
+	lhs.MaxLifetime = rhs.MaxLifetime
+	lhs.MaxConnections = rhs.MaxConnections
+	lhs.MaxPerClient = rhs.MaxPerClient
+	lhs.OverLimit = rhs.OverLimit
+	lhs.QueueTimeout = rhs.QueueTimeout
+	lhs.Allow = rhs.Allow
+	lhs.Deny = rhs.Deny
+	lhs.Bandwidth = rhs.Bandwidth
+	lhs.ConnectionRate = rhs.ConnectionRate
+	lhs.Socket = rhs.Socket
 	return lhs
 }
 
@@ -34,7 +78,38 @@ func (lhs *PipeDefinition) Equal(rhs *PipeDefinition) bool {
 		lhs.Sink == rhs.Sink &&
 		lhs.EnableEp == rhs.EnableEp &&
 		lhs.Service == rhs.Service &&
-		lhs.Namespace == rhs.Namespace
+		lhs.Namespace == rhs.Namespace &&
+		lhs.Protocol == rhs.Protocol &&
+		lhs.Balance == rhs.Balance &&
+		WeightsEqual(lhs.Weights, rhs.Weights) &&
+		HealthEqual(lhs.HealthCheck, rhs.HealthCheck) &&
+		TLSEqual(lhs.TLS, rhs.TLS) &&
+		lhs.SNI == rhs.SNI &&
+		lhs.ProxyProtocol == rhs.ProxyProtocol &&
+		lhs.AcceptProxyProtocol == rhs.AcceptProxyProtocol &&
+		StringsEqual(lhs.TrustedProxies, rhs.TrustedProxies) &&
+		lhs.ConnectTimeout == rhs.ConnectTimeout &&
+		lhs.IdleTimeout == rhs.IdleTimeout &&
+		lhs.MaxLifetime == rhs.MaxLifetime &&
+		lhs.MaxConnections == rhs.MaxConnections &&
+		lhs.MaxPerClient == rhs.MaxPerClient &&
+		lhs.OverLimit == rhs.OverLimit &&
+		lhs.QueueTimeout == rhs.QueueTimeout &&
+		StringsEqual(lhs.Allow, rhs.Allow) &&
+		StringsEqual(lhs.Deny, rhs.Deny) &&
+		BandwidthEqual(lhs.Bandwidth, rhs.Bandwidth) &&
+		ConnectionRateEqual(lhs.ConnectionRate, rhs.ConnectionRate) &&
+		SocketEqual(lhs.Socket, rhs.Socket)
+}
+
+// BindEqual compares the fields that decide how the source is bound,
+// definitions differing only elsewhere can Update a listener in place
+func (lhs *PipeDefinition) BindEqual(rhs *PipeDefinition) bool {
+	return lhs.Source == rhs.Source &&
+		lhs.IsUDP() == rhs.IsUDP() &&
+		strings.EqualFold(lhs.SNI, rhs.SNI) &&
+		TLSEqual(lhs.TLS, rhs.TLS) &&
+		SocketEqual(lhs.Socket, rhs.Socket)
 }
 
 // Copy points w/o erasing EndPoints
@@ -47,5 +122,52 @@ func (lhs *PipeDefinition) Copy(rhs *PipeDefinition) *PipeDefinition {
 	lhs.EnableEp = rhs.EnableEp
 	lhs.Service = rhs.Service
 	lhs.Namespace = rhs.Namespace
+	lhs.Protocol = rhs.Protocol
+	lhs.Balance = rhs.Balance
+	lhs.Weights = rhs.Weights
+	lhs.HealthCheck = rhs.HealthCheck
+	lhs.TLS = rhs.TLS
+	lhs.SNI = rhs.SNI
+	lhs.ProxyProtocol = rhs.ProxyProtocol
+	lhs.AcceptProxyProtocol = rhs.AcceptProxyProtocol
+	lhs.TrustedProxies = rhs.TrustedProxies
+	lhs.ConnectTimeout = rhs.ConnectTimeout
+	lhs.IdleTimeout = rhs.IdleTimeout
+	lhs.MaxLifetime = rhs.MaxLifetime
+	lhs.MaxConnections = rhs.MaxConnections
+	lhs.MaxPerClient = rhs.MaxPerClient
+	lhs.OverLimit = rhs.OverLimit
+	lhs.QueueTimeout = rhs.QueueTimeout
+	lhs.Allow = rhs.Allow
+	lhs.Deny = rhs.Deny
+	lhs.Bandwidth = rhs.Bandwidth
+	lhs.ConnectionRate = rhs.ConnectionRate
+	lhs.Socket = rhs.Socket
 	return lhs
 }
+
+// WeightsEqual compares two balance weight maps
+func WeightsEqual(lhs, rhs map[string]int) bool {
+	if len(lhs) != len(rhs) {
+		return false
+	}
+	for k, v := range lhs {
+		if w, ok := rhs[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// StringsEqual compares two string lists in order
+func StringsEqual(lhs, rhs []string) bool {
+	if len(lhs) != len(rhs) {
+		return false
+	}
+	for i := range lhs {
+		if lhs[i] != rhs[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,7 +1,6 @@
 package listener
 
 import (
-	"fmt"
 	"testing"
 )
 
@@ -23,7 +22,7 @@ var _testPipe1 = TestPipe{
 		PipeDefinition{
 			Source:    "0.0.0.0:8001",
 			Sink:      "0.0.0.0:8002",
-			EndPoints: []string{},
+			Endpoints: []string{},
 			EnableEp:  false,
 			Service:   "echo",
 			Namespace: "test",
@@ -31,7 +30,7 @@ var _testPipe1 = TestPipe{
 		PipeDefinition{
 			Source:    "0.0.0.0:8001",
 			Sink:      "0.0.0.0:8002",
-			EndPoints: []string{},
+			Endpoints: []string{},
 			EnableEp:  false,
 			Service:   "echo",
 			Namespace: "test",
@@ -41,7 +40,7 @@ var _testPipe1 = TestPipe{
 		PipeDefinition{
 			Source:    "0.0.0.0:8002",
 			Sink:      "0.0.0.0:8003",
-			EndPoints: []string{},
+			Endpoints: []string{},
 			EnableEp:  false,
 			Service:   "echo",
 			Namespace: "test",
@@ -49,7 +48,7 @@ var _testPipe1 = TestPipe{
 		PipeDefinition{
 			Source:    "0.0.0.0:8002",
 			Sink:      "0.0.0.0:8004",
-			EndPoints: []string{},
+			Endpoints: []string{},
 			EnableEp:  false,
 			Service:   "echo",
 			Namespace: "test",
@@ -61,7 +60,7 @@ var _TestPipeDefinitionEqual = []PipeDefinition{
 	PipeDefinition{
 		Source:    "0.0.0.0:8001",
 		Sink:      "0.0.0.0:8002",
-		EndPoints: []string{},
+		Endpoints: []string{},
 		EnableEp:  false,
 		Service:   "echo",
 		Namespace: "test",
@@ -69,7 +68,7 @@ var _TestPipeDefinitionEqual = []PipeDefinition{
 	PipeDefinition{
 		Source:    "0.0.0.0:8001",
 		Sink:      "0.0.0.0:8002",
-		EndPoints: []string{},
+		Endpoints: []string{},
 		EnableEp:  false,
 		Service:   "echo",
 		Namespace: "test",
@@ -80,7 +79,7 @@ var _TestPipeDefinitionNotEqual = []PipeDefinition{
 	PipeDefinition{
 		Source:    "0.0.0.0:8002",
 		Sink:      "0.0.0.0:8003",
-		EndPoints: []string{},
+		Endpoints: []string{},
 		EnableEp:  false,
 		Service:   "echo",
 		Namespace: "test",
@@ -88,7 +87,7 @@ var _TestPipeDefinitionNotEqual = []PipeDefinition{
 	PipeDefinition{
 		Source:    "0.0.0.0:8002",
 		Sink:      "0.0.0.0:8004",
-		EndPoints: []string{},
+		Endpoints: []string{},
 		EnableEp:  false,
 		Service:   "echo",
 		Namespace: "test",
@@ -96,13 +95,13 @@ var _TestPipeDefinitionNotEqual = []PipeDefinition{
 }
 
 func TestPipeDefinition(t *testing.T) {
-	if !_TestPipeDefinitionEqual[0].Equal(_TestPipeDefinitionEqual[1]) {
+	if !_TestPipeDefinitionEqual[0].Equal(&_TestPipeDefinitionEqual[1]) {
 		t.Errorf("%v %v", _TestPipeDefinitionEqual[0], _TestPipeDefinitionEqual[1])
 	}
-	if pipe := _TestPipeDefinitionEqual[0].Copy(_TestPipeDefinitionEqual[1]); !pipe.Equal(_TestPipeDefinitionEqual[0]) || !pipe.Equal(_TestPipeDefinitionEqual[1]) {
+	if pipe := NewPipeDefinition(&_TestPipeDefinitionEqual[0]).Copy(&_TestPipeDefinitionEqual[1]); !pipe.Equal(&_TestPipeDefinitionEqual[0]) || !pipe.Equal(&_TestPipeDefinitionEqual[1]) {
 		t.Errorf("%v %v", _TestPipeDefinitionEqual[0], _TestPipeDefinitionEqual[1])
 	}
-	if _TestPipeDefinitionNotEqual[0].Equal(_TestPipeDefinitionNotEqual[1]) {
+	if _TestPipeDefinitionNotEqual[0].Equal(&_TestPipeDefinitionNotEqual[1]) {
 		t.Errorf("%v %v", _TestPipeDefinitionNotEqual[0], _TestPipeDefinitionNotEqual[1])
 	}
 
@@ -121,29 +120,30 @@ func TestPipeDefinitionMap(t *testing.T) {
 	// fmt.Println(m)
 	equal := m["Equal"]
 	notequal := m["!Equal"]
-	if !equal[0].Equal(equal[1]) {
+	if !equal[0].Equal(&equal[1]) {
 		t.Errorf("%v %v", equal[0], equal[1])
 	}
-	if notequal[0].Equal(notequal[1]) {
+	if notequal[0].Equal(&notequal[1]) {
 		t.Errorf("%v %v", notequal[0], notequal[1])
 	}
 
-	if p1, p2 := equal[0].Copy(notequal[0]), equal[1].Copy(notequal[1]); !p1.Equal(notequal[0]) || !p2.Equal(notequal[1]) {
+	if p1, p2 := NewPipeDefinition(&equal[0]).Copy(&notequal[0]), NewPipeDefinition(&equal[1]).Copy(&notequal[1]); !p1.Equal(&notequal[0]) || !p2.Equal(&notequal[1]) {
 		t.Errorf("%v %v", p1, p2)
 	}
-	if p1 := equal[1].Copy(notequal[1]); !p1.Equal(notequal[1]) {
+	if p1 := NewPipeDefinition(&equal[1]).Copy(&notequal[1]); !p1.Equal(&notequal[1]) {
 		t.Errorf("%v %v", p1, notequal[1])
 	}
-	if p2 := equal[1].Copy(notequal[1]); !p2.Equal(notequal[1]) {
+	if p2 := NewPipeDefinition(&equal[1]).Copy(&notequal[1]); !p2.Equal(&notequal[1]) {
 		t.Errorf("%v %v", p2, notequal[1])
 	}
-	if !equal[0].Equal(equal[1]) {
+	if !equal[0].Equal(&equal[1]) {
 		t.Errorf("Copy Value Modified Reference %v %v", equal[0], equal[1])
 	}
-	if notequal[0].Equal(notequal[1]) {
+	if notequal[0].Equal(&notequal[1]) {
 		t.Errorf("Copy Value Modified Reference %v %v", notequal[0], notequal[1])
 	}
-	p1, p2 := equal[0].Copy(notequal[0]), equal[1].Copy(notequal[1])
+	p1, p2 := NewPipeDefinition(&equal[0]).Copy(&notequal[0]), NewPipeDefinition(&equal[1]).Copy(&notequal[1])
+	_, _ = p1, p2
 	// fmt.Println("p1      ", p1)
 	// fmt.Println("equal[0]", equal[0])
 	// fmt.Println("p2      ", p2)
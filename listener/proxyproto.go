@@ -0,0 +1,228 @@
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyV2Signature opens every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// tcpAddr ip and port of a tcp address, nil for any other kind
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp
+	}
+	return nil
+}
+
+// ip6 text of ip in IPv6 form, IPv4 addresses are written as mapped
+// addresses rather than Go's dotted quad
+func ip6(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// ProxyHeader encode the PROXY protocol header for version "v1" or
+// "v2" describing a connection from source to destination, addresses
+// that aren't tcp are sent as UNKNOWN (v1) or LOCAL (v2)
+func ProxyHeader(version string, source, destination net.Addr) ([]byte, error) {
+	var src, dst = tcpAddr(source), tcpAddr(destination)
+	var ip4 = src != nil && dst != nil && src.IP.To4() != nil && dst.IP.To4() != nil
+	switch version {
+	case "v1":
+		switch {
+		case src == nil || dst == nil:
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		case ip4:
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src.IP.To4(), dst.IP.To4(), src.Port, dst.Port)), nil
+		default:
+			return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ip6(src.IP), ip6(dst.IP), src.Port, dst.Port)), nil
+		}
+	case "v2":
+		var header = bytes.NewBuffer(append([]byte{}, proxyV2Signature...))
+		var addresses []byte
+		switch {
+		case src == nil || dst == nil:
+			// LOCAL command, unspecified family, no addresses
+			header.Write([]byte{0x20, 0x00})
+		case ip4:
+			// PROXY command, TCP over IPv4
+			header.Write([]byte{0x21, 0x11})
+			addresses = append(append(addresses, src.IP.To4()...), dst.IP.To4()...)
+		default:
+			// PROXY command, TCP over IPv6
+			header.Write([]byte{0x21, 0x21})
+			addresses = append(append(addresses, src.IP.To16()...), dst.IP.To16()...)
+		}
+		if len(addresses) > 0 {
+			var ports = make([]byte, 4)
+			binary.BigEndian.PutUint16(ports[0:], uint16(src.Port))
+			binary.BigEndian.PutUint16(ports[2:], uint16(dst.Port))
+			addresses = append(addresses, ports...)
+		}
+		binary.Write(header, binary.BigEndian, uint16(len(addresses)))
+		header.Write(addresses)
+		return header.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown proxy-protocol %q", version)
+}
+
+// WriteProxyHeader to w for a connection from source to destination
+func WriteProxyHeader(w io.Writer, version string, source, destination net.Addr) error {
+	header, err := ProxyHeader(version, source, destination)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(header)
+	return err
+}
+
+// proxyV1Max longest v1 header line including the CRLF
+const proxyV1Max = 107
+
+// ReadProxyHeader parse a v1 or v2 PROXY protocol header from r,
+// source and destination are nil for UNKNOWN or LOCAL headers and for
+// families other than tcp
+func ReadProxyHeader(r *bufio.Reader) (source, destination net.Addr, err error) {
+	var prefix []byte
+	if prefix, err = r.Peek(len(proxyV2Signature)); err != nil {
+		if prefix, err = r.Peek(6); err != nil || string(prefix) != "PROXY " {
+			return nil, nil, fmt.Errorf("no PROXY protocol header %v", err)
+		}
+	}
+	if bytes.Equal(prefix, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if string(prefix[:6]) == "PROXY " {
+		return readProxyV1(r)
+	}
+	return nil, nil, fmt.Errorf("no PROXY protocol header")
+}
+
+// readProxyV1 text header
+func readProxyV1(r *bufio.Reader) (source, destination net.Addr, err error) {
+	var line []byte
+	for len(line) < proxyV1Max {
+		var b byte
+		if b, err = r.ReadByte(); err != nil {
+			return
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("PROXY v1 header too long")
+	}
+	var fields = strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+	var src, dst = net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	sport, serr := strconv.ParseUint(fields[4], 10, 16)
+	dport, derr := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || serr != nil || derr != nil {
+		return nil, nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: src, Port: int(sport)}, &net.TCPAddr{IP: dst, Port: int(dport)}, nil
+}
+
+// readProxyV2 binary header
+func readProxyV2(r *bufio.Reader) (source, destination net.Addr, err error) {
+	var header = make([]byte, len(proxyV2Signature)+4)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	var command, family = header[12], header[13]
+	var addresses = make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err = io.ReadFull(r, addresses); err != nil {
+		return
+	}
+	if command>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY version %d", command>>4)
+	}
+	if command&0x0f == 0 {
+		// LOCAL, e.g. the balancer's own health checks
+		return
+	}
+	var size int
+	switch family {
+	case 0x11:
+		size = net.IPv4len
+	case 0x21:
+		size = net.IPv6len
+	default:
+		// udp, unix or unspecified, keep the connection's addresses
+		return
+	}
+	if len(addresses) < size*2+4 {
+		return nil, nil, fmt.Errorf("short PROXY v2 addresses %d", len(addresses))
+	}
+	source = &net.TCPAddr{
+		IP:   net.IP(addresses[:size]),
+		Port: int(binary.BigEndian.Uint16(addresses[size*2:])),
+	}
+	destination = &net.TCPAddr{
+		IP:   net.IP(addresses[size : size*2]),
+		Port: int(binary.BigEndian.Uint16(addresses[size*2+2:])),
+	}
+	return
+}
+
+// ProxiedConn a connection whose addresses came from a PROXY header
+type ProxiedConn struct {
+	net.Conn
+	reader      *bufio.Reader
+	source      net.Addr
+	destination net.Addr
+}
+
+// AcceptProxyHeader read the PROXY header from conn within timeout
+func AcceptProxyHeader(conn net.Conn, timeout time.Duration) (*ProxiedConn, error) {
+	var proxied = &ProxiedConn{Conn: conn, reader: bufio.NewReader(conn)}
+	var err error
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	proxied.source, proxied.destination, err = ReadProxyHeader(proxied.reader)
+	conn.SetReadDeadline(time.Time{})
+	return proxied, err
+}
+
+// Read past the header
+func (c *ProxiedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// CloseWrite half close the underlying connection
+func (c *ProxiedConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+// RemoteAddr the client's address from the header
+func (c *ProxiedConn) RemoteAddr() net.Addr {
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr the address the client connected to from the header
+func (c *ProxiedConn) LocalAddr() net.Addr {
+	if c.destination != nil {
+		return c.destination
+	}
+	return c.Conn.LocalAddr()
+}
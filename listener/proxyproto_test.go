@@ -0,0 +1,154 @@
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/davidwalter0/forwarder/kubeconfig"
+)
+
+func tcp(address string) net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", address)
+	return addr
+}
+
+var _proxyHeaders = []struct {
+	version     string
+	source      net.Addr
+	destination net.Addr
+	header      []byte
+}{
+	{"v1", tcp("192.168.1.10:40000"), tcp("10.0.0.1:443"), []byte("PROXY TCP4 192.168.1.10 10.0.0.1 40000 443\r\n")},
+	{"v1", tcp("[2001:db8::1]:40000"), tcp("[2001:db8::2]:443"), []byte("PROXY TCP6 2001:db8::1 2001:db8::2 40000 443\r\n")},
+	{"v1", &net.UnixAddr{Name: "/tmp/s", Net: "unix"}, tcp("10.0.0.1:443"), []byte("PROXY UNKNOWN\r\n")},
+	{"v2", tcp("192.168.1.10:40000"), tcp("10.0.0.1:443"), append(append([]byte{}, proxyV2Signature...),
+		0x21, 0x11, 0x00, 0x0c,
+		192, 168, 1, 10, 10, 0, 0, 1,
+		0x9c, 0x40, 0x01, 0xbb)},
+	{"v2", tcp("192.168.1.10:40000"), tcp("[2001:db8::2]:443"), append(append([]byte{}, proxyV2Signature...),
+		0x21, 0x21, 0x00, 0x24,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 192, 168, 1, 10,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+		0x9c, 0x40, 0x01, 0xbb)},
+	{"v2", &net.UnixAddr{Name: "/tmp/s", Net: "unix"}, tcp("10.0.0.1:443"), append(append([]byte{}, proxyV2Signature...),
+		0x20, 0x00, 0x00, 0x00)},
+}
+
+func TestProxyHeader(t *testing.T) {
+	for _, test := range _proxyHeaders {
+		header, err := ProxyHeader(test.version, test.source, test.destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(header, test.header) {
+			t.Errorf("%s %v %v\nGot:\t\t%q\nExpected:\t%q\n", test.version, test.source, test.destination, header, test.header)
+		}
+	}
+	if _, err := ProxyHeader("v3", tcp("10.0.0.1:1"), tcp("10.0.0.2:2")); err == nil {
+		t.Error("expected error for unknown version")
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, test := range _proxyHeaders {
+		source, destination, err := ReadProxyHeader(bufio.NewReader(bytes.NewReader(append(test.header, "payload"...))))
+		if err != nil {
+			t.Fatalf("%q %v", test.header, err)
+		}
+		var expectSource, expectDestination = tcpAddr(test.source), tcpAddr(test.destination)
+		if expectSource == nil || expectDestination == nil {
+			if source != nil || destination != nil {
+				t.Errorf("%q expected no addresses got %v %v", test.header, source, destination)
+			}
+			continue
+		}
+		if !tcpAddr(source).IP.Equal(expectSource.IP) || tcpAddr(source).Port != expectSource.Port ||
+			!tcpAddr(destination).IP.Equal(expectDestination.IP) || tcpAddr(destination).Port != expectDestination.Port {
+			t.Errorf("%q got %v %v", test.header, source, destination)
+		}
+	}
+	for _, header := range []string{"GET / HTTP/1.1\r\n", "PROXY TCP4 1.2.3.4\r\n", "PROXY TCP4 1.2.3.4 5.6.7.8 1 99999\r\n"} {
+		if _, _, err := ReadProxyHeader(bufio.NewReader(bytes.NewBufferString(header))); err == nil {
+			t.Errorf("%q expected error", header)
+		}
+	}
+}
+
+// TestProxyChain accepts a v2 header from a balancer in front and
+// re-emits the real client address downstream as v1
+func TestProxyChain(t *testing.T) {
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	var received = make(chan string, 1)
+	go func() {
+		conn, err := sink.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- line
+	}()
+
+	ml := NewManagedListener("chain", &PipeDefinition{
+		Source:              "127.0.0.1:0",
+		Sink:                sink.Addr().String(),
+		AcceptProxyProtocol: true,
+		ProxyProtocol:       "v1",
+	}, kubeconfig.KubeConfig{})
+	ml.Open()
+	defer ml.Close()
+
+	conn, err := net.Dial("tcp", ml.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = WriteProxyHeader(conn, "v2", tcp("203.0.113.7:51000"), tcp("198.51.100.1:443")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case line := <-received:
+		if expected := "PROXY TCP4 203.0.113.7 198.51.100.1 51000 443\r\n"; line != expected {
+			t.Fatalf("Got:\t\t%q\nExpected:\t%q\n", line, expected)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no header received")
+	}
+}
+
+// TestTrustedProxies only trusted peers may send a PROXY header
+func TestTrustedProxies(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+	for trusted, expected := range map[string]bool{"127.0.0.0/8": true, "192.0.2.1": false} {
+		ml := NewManagedListener("trusted", &PipeDefinition{
+			Source:              "127.0.0.1:0",
+			Sink:                sink.Addr().String(),
+			AcceptProxyProtocol: true,
+			TrustedProxies:      []string{trusted},
+		}, kubeconfig.KubeConfig{})
+		ml.Open()
+		conn, err := net.Dial("tcp", ml.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		WriteProxyHeader(conn, "v1", tcp("203.0.113.7:51000"), tcp("198.51.100.1:443"))
+		conn.Write([]byte("ping"))
+		var reply = make([]byte, 4)
+		_, err = io.ReadFull(conn, reply)
+		if (err == nil) != expected {
+			t.Errorf("trusted %s expected forwarded %v got %q %v", trusted, expected, reply, err)
+		}
+		conn.Close()
+		ml.Close()
+	}
+}
@@ -0,0 +1,141 @@
+package listener
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// banWindow violations counting toward a ban must fall within it
+var banWindow = time.Minute
+
+// ConnectionRate new connections allowed per client host, clients
+// going over the rate ban-after times within a minute are refused for
+// ban-duration
+type ConnectionRate struct {
+	Rate        float64       `json:"rate"         help:"new connections per second from one client host"`
+	Burst       int           `json:"burst"        help:"connections a client opens at once before rate applies, rate rounded up when unset"`
+	BanAfter    int           `json:"ban-after"    yaml:"ban-after" help:"violations within a minute that ban the client, unset never bans"`
+	BanDuration time.Duration `json:"ban-duration" yaml:"ban-duration" help:"how long a ban lasts, 5m when unset"`
+}
+
+// ConnectionRateEqual compares two connection rate definitions
+func ConnectionRateEqual(lhs, rhs *ConnectionRate) bool {
+	if lhs == nil || rhs == nil {
+		return lhs == rhs
+	}
+	return *lhs == *rhs
+}
+
+// clientRate a client's bucket, violations and ban
+type clientRate struct {
+	limiter    *rate.Limiter
+	violations int
+	window     time.Time
+	banned     time.Time
+	seen       time.Time
+}
+
+// RateLimiter connection rate by client host for one listener
+type RateLimiter struct {
+	ConnectionRate
+	mutex   sync.Mutex
+	clients map[string]*clientRate
+	swept   time.Time
+}
+
+// NewRateLimiter for connectionRate, nil when it's unset
+func NewRateLimiter(connectionRate *ConnectionRate) *RateLimiter {
+	if connectionRate == nil || connectionRate.Rate <= 0 {
+		return nil
+	}
+	var r = &RateLimiter{ConnectionRate: *connectionRate, clients: make(map[string]*clientRate), swept: time.Now()}
+	if r.Burst <= 0 {
+		r.Burst = int(r.Rate + 0.999)
+	}
+	if r.BanDuration <= 0 {
+		r.BanDuration = time.Minute * 5
+	}
+	return r
+}
+
+// RateError a connection refused by the connection rate
+type RateError struct {
+	Reason string
+	Until  time.Time
+}
+
+// Error text with the ban's end
+func (err *RateError) Error() string {
+	if err.Until.IsZero() {
+		return err.Reason
+	}
+	return fmt.Sprintf("%s until %s", err.Reason, err.Until.Format(time.RFC3339))
+}
+
+// Allow a new connection from client, a RateError when it's over the
+// rate or banned
+func (r *RateLimiter) Allow(client string) error {
+	if r == nil {
+		return nil
+	}
+	var now = time.Now()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.sweep(now)
+	cr, ok := r.clients[client]
+	if !ok {
+		cr = &clientRate{limiter: rate.NewLimiter(rate.Limit(r.Rate), r.Burst)}
+		r.clients[client] = cr
+	}
+	cr.seen = now
+	if now.Before(cr.banned) {
+		return &RateError{Reason: "banned", Until: cr.banned}
+	}
+	if cr.limiter.AllowN(now, 1) {
+		return nil
+	}
+	if now.Sub(cr.window) > banWindow {
+		cr.window, cr.violations = now, 0
+	}
+	if cr.violations++; r.BanAfter > 0 && cr.violations >= r.BanAfter {
+		cr.banned, cr.violations = now.Add(r.BanDuration), 0
+		slog.Warn("banned", "client", client, "until", cr.banned, "violations", r.BanAfter, "rate", r.Rate)
+		return &RateError{Reason: "banned", Until: cr.banned}
+	}
+	return &RateError{Reason: "rate-limited"}
+}
+
+// Banned clients and when their bans end
+func (r *RateLimiter) Banned() map[string]time.Time {
+	var banned = make(map[string]time.Time)
+	if r == nil {
+		return banned
+	}
+	var now = time.Now()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for client, cr := range r.clients {
+		if now.Before(cr.banned) {
+			banned[client] = cr.banned
+		}
+	}
+	return banned
+}
+
+// sweep forget clients that are neither banned nor seen within the
+// window, once per window, with mutex held
+func (r *RateLimiter) sweep(now time.Time) {
+	if now.Sub(r.swept) < banWindow {
+		return
+	}
+	r.swept = now
+	for client, cr := range r.clients {
+		if now.After(cr.banned) && now.Sub(cr.seen) > banWindow {
+			delete(r.clients, client)
+		}
+	}
+}
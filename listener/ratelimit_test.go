@@ -0,0 +1,64 @@
+package listener
+
+import (
+	"testing"
+	"time"
+
+	"github.com/davidwalter0/forwarder/kubeconfig"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if NewRateLimiter(nil).Allow("a") != nil {
+		t.Fatal("expected no limit without a rate")
+	}
+	var limiter = NewRateLimiter(&ConnectionRate{Rate: 1, Burst: 2, BanAfter: 3, BanDuration: time.Minute})
+	for i := 0; i < 2; i++ {
+		if err := limiter.Allow("a"); err != nil {
+			t.Fatalf("burst connection %d refused %v", i, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err, ok := limiter.Allow("a").(*RateError); !ok || err.Reason != "rate-limited" {
+			t.Fatalf("expected rate-limited got %v", err)
+		}
+	}
+	if err := limiter.Allow("b"); err != nil {
+		t.Fatalf("expected other clients unaffected got %v", err)
+	}
+	if err, ok := limiter.Allow("a").(*RateError); !ok || err.Reason != "banned" {
+		t.Fatalf("expected a ban after 3 violations got %v", err)
+	}
+	if _, ok := limiter.Banned()["a"]; !ok || len(limiter.Banned()) != 1 {
+		t.Errorf("expected a banned got %v", limiter.Banned())
+	}
+	// the ban outlasts the bucket refilling
+	time.Sleep(time.Millisecond * 1100)
+	if err, ok := limiter.Allow("a").(*RateError); !ok || err.Reason != "banned" {
+		t.Errorf("expected still banned got %v", err)
+	}
+}
+
+func TestConnectionRate(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+	ml := NewManagedListener("rated", &PipeDefinition{
+		Source:         "127.0.0.1:0",
+		Sink:           sink.Addr().String(),
+		ConnectionRate: &ConnectionRate{Rate: 0.1, Burst: 2, BanAfter: 2},
+	}, kubeconfig.KubeConfig{})
+	ml.Open()
+	defer ml.Close()
+	var source = ml.Listener.Addr().String()
+	for i, expected := range []bool{true, true, false, false, false} {
+		conn, ok := open(t, source)
+		if ok {
+			conn.Close()
+		}
+		if ok != expected {
+			t.Errorf("connection %d expected %v got %v", i, expected, ok)
+		}
+	}
+	if _, ok := ml.Status().Banned["127.0.0.1"]; !ok {
+		t.Errorf("expected the client banned %+v", ml.Status())
+	}
+}
@@ -0,0 +1,77 @@
+package listener
+
+import (
+	"sort"
+	"sync"
+)
+
+// Registry the active pipes of a listener by ID, safe for concurrent
+// use from the accept, copy and admin goroutines
+type Registry struct {
+	mutex  sync.Mutex
+	pipes  map[uint64]*Pipe
+	closed bool
+}
+
+// NewRegistry create an empty registry
+func NewRegistry() *Registry {
+	return &Registry{pipes: make(map[uint64]*Pipe)}
+}
+
+// Add pipe, false when the registry is closed and pipe wasn't added
+func (r *Registry) Add(pipe *Pipe) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return false
+	}
+	pipe.registry = r
+	r.pipes[pipe.ID] = pipe
+	return true
+}
+
+// Remove pipe, removing a pipe that isn't registered is a no-op
+func (r *Registry) Remove(pipe *Pipe) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.pipes[pipe.ID] == pipe {
+		delete(r.pipes, pipe.ID)
+	}
+}
+
+// Get the pipe with id, nil when it isn't active
+func (r *Registry) Get(id uint64) *Pipe {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.pipes[id]
+}
+
+// Len number of active pipes
+func (r *Registry) Len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.pipes)
+}
+
+// Snapshot of the active pipes ordered by ID, pipes may close after
+// it's taken
+func (r *Registry) Snapshot() (pipes []*Pipe) {
+	r.mutex.Lock()
+	for _, pipe := range r.pipes {
+		pipes = append(pipes, pipe)
+	}
+	r.mutex.Unlock()
+	sort.Slice(pipes, func(i, j int) bool { return pipes[i].ID < pipes[j].ID })
+	return
+}
+
+// Close every active pipe and refuse further Adds
+func (r *Registry) Close() {
+	r.mutex.Lock()
+	r.closed = true
+	r.mutex.Unlock()
+	// pipes remove themselves as they close
+	for _, pipe := range r.Snapshot() {
+		pipe.Close()
+	}
+}
@@ -0,0 +1,69 @@
+package listener
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+// pipe over in memory connections
+func pipe() *Pipe {
+	source, _ := net.Pipe()
+	sink, _ := net.Pipe()
+	return NewPipe("registry", source, sink, "sink:1")
+}
+
+func TestRegistry(t *testing.T) {
+	var registry = NewRegistry()
+	var pipes []*Pipe
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := pipe()
+			if !registry.Add(p) {
+				t.Error("add refused")
+			}
+			mutex.Lock()
+			pipes = append(pipes, p)
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+	if registry.Len() != 50 {
+		t.Fatalf("expected 50 pipes got %d", registry.Len())
+	}
+	var snapshot = registry.Snapshot()
+	for i := 1; i < len(snapshot); i++ {
+		if snapshot[i-1].ID >= snapshot[i].ID {
+			t.Fatal("snapshot not ordered by id")
+		}
+	}
+	if registry.Get(snapshot[0].ID) != snapshot[0] {
+		t.Error("get by id")
+	}
+
+	// every pipe closed twice concurrently
+	for _, p := range pipes[:25] {
+		wg.Add(2)
+		go func(p *Pipe) { defer wg.Done(); p.Close() }(p)
+		go func(p *Pipe) { defer wg.Done(); p.Close() }(p)
+	}
+	wg.Wait()
+	if registry.Len() != 25 {
+		t.Fatalf("expected 25 pipes got %d", registry.Len())
+	}
+	if registry.Get(pipes[0].ID) != nil {
+		t.Error("closed pipe still registered")
+	}
+
+	registry.Close()
+	if registry.Len() != 0 {
+		t.Fatalf("expected no pipes after close got %d", registry.Len())
+	}
+	if registry.Add(pipe()) {
+		t.Error("expected a closed registry to refuse pipes")
+	}
+}
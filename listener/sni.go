@@ -0,0 +1,228 @@
+package listener
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SharedListener one bound source whose connections are routed to
+// ManagedListeners by the server name in the tls ClientHello, tls is
+// passed through untouched
+type SharedListener struct {
+	Source   string
+	Listener net.Listener
+	mutex    sync.Mutex
+	routes   map[string]*SNIListener
+}
+
+// shared listeners by source address
+var shared = struct {
+	sync.Mutex
+	listeners map[string]*SharedListener
+}{listeners: make(map[string]*SharedListener)}
+
+// ListenSNI route connections for serverName on address, binding the
+// address for the first route, nil if the address can't be bound or
+// serverName is already routed there
+func ListenSNI(address, serverName string) net.Listener {
+	serverName = strings.ToLower(serverName)
+	shared.Lock()
+	defer shared.Unlock()
+	sl, ok := shared.listeners[address]
+	if !ok {
+		var listener = Listen(address)
+		if listener == nil {
+			return nil
+		}
+		sl = &SharedListener{Source: address, Listener: listener, routes: make(map[string]*SNIListener)}
+		shared.listeners[address] = sl
+		go sl.Routing()
+	}
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+	if _, ok := sl.routes[serverName]; ok {
+		slog.Warn("sni already routed", "sni", serverName, "source", address)
+		return nil
+	}
+	route := &SNIListener{
+		ServerName: serverName,
+		shared:     sl,
+		conns:      make(chan net.Conn),
+		done:       make(chan bool),
+	}
+	sl.routes[serverName] = route
+	return route
+}
+
+// Route for serverName, an exact match, then the closest *.domain
+// wildcard, then the * catch all
+func (sl *SharedListener) Route(serverName string) *SNIListener {
+	serverName = strings.ToLower(serverName)
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+	if route, ok := sl.routes[serverName]; ok {
+		return route
+	}
+	for name := serverName; strings.Contains(name, "."); {
+		name = name[strings.Index(name, ".")+1:]
+		if route, ok := sl.routes["*."+name]; ok {
+			return route
+		}
+	}
+	return sl.routes["*"]
+}
+
+// remove route, closing the shared listener with the last route
+func (sl *SharedListener) remove(route *SNIListener) {
+	shared.Lock()
+	defer shared.Unlock()
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+	if sl.routes[route.ServerName] == route {
+		delete(sl.routes, route.ServerName)
+	}
+	if len(sl.routes) == 0 {
+		sl.Listener.Close()
+		if shared.listeners[sl.Source] == sl {
+			delete(shared.listeners, sl.Source)
+		}
+	}
+}
+
+// Routing accept and hand each connection to it's route
+func (sl *SharedListener) Routing() {
+	for {
+		conn, err := sl.Listener.Accept()
+		if err != nil {
+			shared.Lock()
+			closed := shared.listeners[sl.Source] != sl
+			shared.Unlock()
+			if closed {
+				return
+			}
+			slog.Warn("accept failed", "source", sl.Source, "err", err)
+			time.Sleep(acceptBackoff)
+			continue
+		}
+		go sl.route(conn)
+	}
+}
+
+// route conn by it's ClientHello
+func (sl *SharedListener) route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	serverName, peeked, err := PeekServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		slog.Warn("sni failed", "source", sl.Source, "client", conn.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+	route := sl.Route(serverName)
+	if route == nil {
+		slog.Warn("no route for sni", "source", sl.Source, "client", conn.RemoteAddr(), "sni", serverName)
+		conn.Close()
+		return
+	}
+	select {
+	case route.conns <- &PeekedConn{Conn: conn, Reader: io.MultiReader(bytes.NewReader(peeked), conn)}:
+	case <-route.done:
+		conn.Close()
+	}
+}
+
+// errPeeked stops the handshake once the ClientHello is read
+var errPeeked = errors.New("peeked")
+
+// recorder read only conn keeping a copy of what was read
+type recorder struct {
+	net.Conn
+	bytes.Buffer
+}
+
+// Read and record
+func (r *recorder) Read(b []byte) (n int, err error) {
+	n, err = r.Conn.Read(b)
+	r.Buffer.Write(b[:n])
+	return
+}
+
+// Write nothing, the handshake is never answered
+func (r *recorder) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// PeekServerName read the tls ClientHello from conn, returning the
+// server name requested and the bytes consumed
+func PeekServerName(conn net.Conn) (serverName string, peeked []byte, err error) {
+	var r = &recorder{Conn: conn}
+	var hello *tls.ClientHelloInfo
+	err = tls.Server(r, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errPeeked
+		},
+	}).Handshake()
+	if hello == nil {
+		return "", r.Bytes(), fmt.Errorf("no tls ClientHello %v", err)
+	}
+	return hello.ServerName, r.Bytes(), nil
+}
+
+// PeekedConn replays the peeked ClientHello before reading on
+type PeekedConn struct {
+	net.Conn
+	io.Reader
+}
+
+// Read from the replay reader
+func (c *PeekedConn) Read(b []byte) (int, error) {
+	return c.Reader.Read(b)
+}
+
+// CloseWrite half close the underlying connection
+func (c *PeekedConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+// SNIListener the connections routed to one server name of a
+// SharedListener
+type SNIListener struct {
+	ServerName string
+	shared     *SharedListener
+	conns      chan net.Conn
+	done       chan bool
+	once       sync.Once
+}
+
+// Accept the next routed connection
+func (l *SNIListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, fmt.Errorf("sni %s on %s closed", l.ServerName, l.shared.Source)
+	}
+}
+
+// Close the route, the source is unbound with it's last route
+func (l *SNIListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.shared.remove(l)
+	})
+	return nil
+}
+
+// Addr of the shared source
+func (l *SNIListener) Addr() net.Addr {
+	return l.shared.Listener.Addr()
+}
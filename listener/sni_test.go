@@ -0,0 +1,88 @@
+package listener
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/davidwalter0/forwarder/kubeconfig"
+)
+
+// named tls server answering every connection with it's name
+func named(t *testing.T, dir, name string) net.Listener {
+	cert, key := writeCertificate(t, dir, name)
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{pair}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(name))
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+// reached the name of the server answering address for serverName
+func reached(t *testing.T, address, serverName string) string {
+	conn, err := tls.Dial("tcp", address, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	text, _ := ioutil.ReadAll(conn)
+	return string(text)
+}
+
+func TestSNIRouting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwarder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var source = dead(t)
+	var routes = map[string]string{
+		"a.example.com":   "a",
+		"*.b.example.com": "b",
+		"*":               "default",
+	}
+	for sni, name := range routes {
+		sink := named(t, dir, name)
+		defer sink.Close()
+		ml := NewManagedListener(name, &PipeDefinition{Source: source, Sink: sink.Addr().String(), SNI: sni}, kubeconfig.KubeConfig{})
+		if ml.Listener == nil {
+			t.Fatalf("%s not routed", sni)
+		}
+		ml.Open()
+		defer ml.Close()
+	}
+
+	if duplicate := ListenSNI(source, "A.example.com"); duplicate != nil {
+		t.Fatal("expected duplicate server name to be refused")
+	}
+
+	for serverName, expected := range map[string]string{
+		"a.example.com":     "a",
+		"x.b.example.com":   "b",
+		"x.y.b.example.com": "b",
+		"c.example.com":     "default",
+	} {
+		if got := reached(t, source, serverName); got != expected {
+			t.Errorf("%s expected %s got %s", serverName, expected, got)
+		}
+	}
+}
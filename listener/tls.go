@@ -0,0 +1,177 @@
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// tlsSettle quiet period after a change before reloading
+var tlsSettle = time.Millisecond * 250
+
+// TLSConfig files for terminating tls on a pipe's source
+type TLSConfig struct {
+	Cert     string `json:"cert"     help:"pem certificate chain file"`
+	Key      string `json:"key"      help:"pem private key file"`
+	ClientCA string `json:"clientCA" yaml:"clientCA" help:"pem ca bundle file, when set clients must present a certificate it signed"`
+}
+
+// TLSEqual compares two tls definitions
+func TLSEqual(lhs, rhs *TLSConfig) bool {
+	if lhs == nil || rhs == nil {
+		return lhs == rhs
+	}
+	return *lhs == *rhs
+}
+
+// Certificates loaded from a TLSConfig's files, reloaded when the
+// files change
+type Certificates struct {
+	TLSConfig
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+// NewCertificates load the files named in config, on error the
+// certificates are still returned and handshakes fail until a reload
+func NewCertificates(config TLSConfig) (certificates *Certificates, err error) {
+	certificates = &Certificates{TLSConfig: config}
+	err = certificates.Load()
+	return
+}
+
+// Load (or reload) the certificate, key and client ca files, the
+// previous certificates stay in use on error
+func (certificates *Certificates) Load() error {
+	certificate, err := tls.LoadX509KeyPair(certificates.Cert, certificates.Key)
+	if err != nil {
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if len(certificates.ClientCA) > 0 {
+		var text []byte
+		if text, err = ioutil.ReadFile(certificates.ClientCA); err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(text) {
+			return fmt.Errorf("no certificates found in %s", certificates.ClientCA)
+		}
+	}
+	certificates.mutex.Lock()
+	defer certificates.mutex.Unlock()
+	certificates.certificate = &certificate
+	certificates.clientCAs = clientCAs
+	return nil
+}
+
+// Config for the tls.Server handshake in Serve, each handshake uses
+// the most recently loaded certificates
+func (certificates *Certificates) Config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			certificates.mutex.RLock()
+			defer certificates.mutex.RUnlock()
+			if certificates.certificate == nil {
+				return nil, fmt.Errorf("%s isn't loaded", certificates.Cert)
+			}
+			var config = &tls.Config{
+				Certificates: []tls.Certificate{*certificates.certificate},
+			}
+			if certificates.clientCAs != nil {
+				config.ClientCAs = certificates.clientCAs
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}
+}
+
+// loaded reports if a certificate has been loaded
+func (certificates *Certificates) loaded() bool {
+	certificates.mutex.RLock()
+	defer certificates.mutex.RUnlock()
+	return certificates.certificate != nil
+}
+
+// files to watch for changes
+func (certificates *Certificates) files() (files []string) {
+	files = []string{certificates.Cert, certificates.Key}
+	if len(certificates.ClientCA) > 0 {
+		files = append(files, certificates.ClientCA)
+	}
+	return
+}
+
+// settle consume events until the files are quiet for tlsSettle
+func (certificates *Certificates) settle(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case <-watcher.Events:
+		case <-time.After(tlsSettle):
+			return
+		}
+	}
+}
+
+// Watch reload the certificates when their files change until done is
+// closed
+func (certificates *Certificates) Watch(done <-chan bool) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("tls watch failed", "err", err)
+		return
+	}
+	defer watcher.Close()
+	// stale until the files load, they may be mounted after the pipe
+	// is opened
+	var stale = !certificates.loaded()
+	for {
+		// Secret update -> REMOVE event, invalidates the watch,
+		// reassert
+		for _, file := range certificates.files() {
+			if err = watcher.Add(file); err != nil {
+				slog.Error("tls watch failed", "file", file, "err", err)
+				break
+			}
+		}
+		if err != nil {
+			stale = true
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Second * 3):
+				continue
+			}
+		}
+		if stale {
+			if err = certificates.Load(); err != nil {
+				slog.Error("tls load failed", "cert", certificates.Cert, "err", err)
+			} else {
+				stale = false
+				slog.Info("tls reload", "cert", certificates.Cert)
+			}
+		}
+		select {
+		case <-done:
+			return
+		case event := <-watcher.Events:
+			// cert and key are usually replaced together, let both land
+			certificates.settle(watcher)
+			if err = certificates.Load(); err != nil {
+				slog.Error("tls reload failed", "file", event.Name, "err", err)
+			} else {
+				slog.Info("tls reload", "file", event.Name, "cert", certificates.Cert)
+			}
+		case err := <-watcher.Errors:
+			slog.Error("tls watch failed", "err", err)
+		}
+	}
+}
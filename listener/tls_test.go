@@ -0,0 +1,204 @@
+package listener
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/davidwalter0/forwarder/kubeconfig"
+)
+
+// writeCertificate self signed for name into dir as tls.crt and
+// tls.key
+func writeCertificate(t *testing.T, dir, name string) (cert, key string) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &private.PublicKey, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, key = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	// write then rename so a watcher never sees a partial file
+	for file, block := range map[string]*pem.Block{
+		cert: {Type: "CERTIFICATE", Bytes: der},
+		key:  {Type: "EC PRIVATE KEY", Bytes: keyDer},
+	} {
+		if err = ioutil.WriteFile(file+".tmp", pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Rename(file+".tmp", file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return
+}
+
+// served common name of the certificate presented on address
+func served(t *testing.T, address string) string {
+	conn, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	var buffer = make([]byte, 4)
+	if _, err = io.ReadFull(conn, buffer); err != nil || string(buffer) != "ping" {
+		t.Fatalf("expected ping got %q %v", buffer, err)
+	}
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestTLSTermination(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+	dir, err := ioutil.TempDir("", "forwarder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := writeCertificate(t, dir, "first")
+
+	ml := NewManagedListener("tls", &PipeDefinition{
+		Source: "127.0.0.1:0",
+		Sink:   sink.Addr().String(),
+		TLS:    &TLSConfig{Cert: cert, Key: key},
+	}, kubeconfig.KubeConfig{})
+	if ml.Listener == nil {
+		t.Fatal("tls listener not bound")
+	}
+	ml.Open()
+	defer ml.Close()
+
+	var address = ml.Listener.Addr().String()
+	if name := served(t, address); name != "first" {
+		t.Fatalf("expected first certificate got %s", name)
+	}
+
+	writeCertificate(t, dir, "second")
+	var deadline = time.Now().Add(time.Second * 5)
+	for served(t, address) != "second" {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate not reloaded")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+func TestTLSClientCA(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+	dir, err := ioutil.TempDir("", "forwarder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := writeCertificate(t, dir, "server")
+
+	ml := NewManagedListener("mtls", &PipeDefinition{
+		Source: "127.0.0.1:0",
+		Sink:   sink.Addr().String(),
+		TLS:    &TLSConfig{Cert: cert, Key: key, ClientCA: cert},
+	}, kubeconfig.KubeConfig{})
+	ml.Open()
+	defer ml.Close()
+
+	conn, err := tls.Dial("tcp", ml.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		conn.Write([]byte("ping"))
+		_, err = conn.Read(make([]byte, 4))
+		conn.Close()
+	}
+	if err == nil {
+		t.Fatal("expected client without a certificate to be refused")
+	}
+
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = tls.Dial("tcp", ml.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{pair}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	conn.Write([]byte("ping"))
+	if _, err = io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSLoadedLater(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+	dir, err := ioutil.TempDir("", "forwarder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ml := NewManagedListener("tls", &PipeDefinition{
+		Source: "127.0.0.1:0",
+		Sink:   sink.Addr().String(),
+		TLS:    &TLSConfig{Cert: filepath.Join(dir, "tls.crt"), Key: filepath.Join(dir, "tls.key")},
+	}, kubeconfig.KubeConfig{})
+	if ml.Listener == nil {
+		t.Fatal("tls listener not bound")
+	}
+	ml.Open()
+	defer ml.Close()
+
+	var address = ml.Listener.Addr().String()
+	if conn, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true}); err == nil {
+		conn.Close()
+		t.Fatal("expected handshakes refused before the files load")
+	}
+	writeCertificate(t, dir, "late")
+	var deadline = time.Now().Add(time.Second * 10)
+	for {
+		conn, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true})
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate never loaded %v", err)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if name := served(t, address); name != "late" {
+		t.Fatalf("expected late certificate got %s", name)
+	}
+}
@@ -0,0 +1,213 @@
+package listener
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/davidwalter0/forwarder/metrics"
+	"github.com/davidwalter0/forwarder/tracer"
+)
+
+// UDPIdleTimeout expire a client flow after no datagrams in either
+// direction for this long
+var UDPIdleTimeout = time.Second * 60
+
+// MaxFlows open at once per udp pipe, datagrams from further clients
+// are dropped until a flow ends, 0 for no limit
+var MaxFlows = 4096
+
+// udpBufferSize max size of a datagram
+const udpBufferSize = 65535
+
+// ListenPacket open a datagram listener on address
+func ListenPacket(address string) (conn net.PacketConn) {
+	var err error
+	for i := 0; i < retries; i++ {
+		conn, err = net.ListenPacket("udp", address)
+		if err != nil {
+			slog.Error("listen failed", "source", address, "protocol", "udp", "err", err)
+		} else {
+			return conn
+		}
+	}
+	return
+}
+
+// Flow a udp client address and it's dedicated connection to the sink
+type Flow struct {
+	Client   net.Addr
+	SinkConn net.Conn
+	Sink     string
+	last     int64
+	once     sync.Once
+	done     func()
+}
+
+// Touch record activity on the flow
+func (flow *Flow) Touch() {
+	atomic.StoreInt64(&flow.last, time.Now().UnixNano())
+}
+
+// Idle duration since the last datagram
+func (flow *Flow) Idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&flow.last))
+}
+
+// Close the sink side of the flow
+func (flow *Flow) Close() {
+	flow.once.Do(func() {
+		flow.SinkConn.Close()
+	})
+}
+
+// Flow find or create the flow for client, the sink is dialed
+// without holding the listener's mutex
+func (ml *ManagedListener) Flow(client net.Addr) (flow *Flow, err error) {
+	if flow, err = ml.flow(client); flow != nil || err != nil {
+		return
+	}
+	SinkConn, sink, balancer, err := ml.dial(client)
+	if err != nil {
+		return
+	}
+	defer ml.Monitor()()
+	// another datagram may have opened one, or the last slot, meanwhile
+	if flow, err = ml.lookupFlow(client); flow != nil || err != nil {
+		SinkConn.Close()
+		balancer.Done(sink)
+		return
+	}
+	metrics.Accepted.WithLabelValues(ml.Name).Inc()
+	metrics.Active.WithLabelValues(ml.Name).Inc()
+	flow = &Flow{Client: client, SinkConn: SinkConn, Sink: sink, done: func() { balancer.Done(sink) }}
+	flow.Touch()
+	ml.Flows[client.String()] = flow
+	go ml.Reply(flow)
+	return
+}
+
+// flow for client, nil without an error when a new one may be opened
+func (ml *ManagedListener) flow(client net.Addr) (*Flow, error) {
+	defer ml.Monitor()()
+	return ml.lookupFlow(client)
+}
+
+// lookupFlow with the mutex held, a LimitError when client has no flow
+// and the pipe is at MaxFlows
+func (ml *ManagedListener) lookupFlow(client net.Addr) (*Flow, error) {
+	if flow, ok := ml.Flows[client.String()]; ok {
+		return flow, nil
+	}
+	if MaxFlows > 0 && len(ml.Flows) >= MaxFlows {
+		metrics.Rejected.WithLabelValues(ml.Name, "max-flows").Inc()
+		return nil, &LimitError{Limit: "max-flows", Max: MaxFlows}
+	}
+	return nil, nil
+}
+
+// RemoveFlow close and forget flow
+func (ml *ManagedListener) RemoveFlow(flow *Flow) {
+	flow.Close()
+	defer ml.Monitor()()
+	if ml.Flows[flow.Client.String()] == flow {
+		delete(ml.Flows, flow.Client.String())
+		metrics.Active.WithLabelValues(ml.Name).Dec()
+		flow.done()
+	}
+}
+
+// Reply copy datagrams from the sink back to the flow's client
+func (ml *ManagedListener) Reply(flow *Flow) {
+	defer trace.Tracer.Enable(trace.Enabled).ScopedTrace()()
+	defer ml.RemoveFlow(flow)
+	var out = metrics.Bytes.WithLabelValues(ml.Name, "out")
+	var buffer = make([]byte, udpBufferSize)
+	for {
+		n, err := flow.SinkConn.Read(buffer)
+		if err != nil {
+			return
+		}
+		flow.Touch()
+		if _, err = ml.PacketConn.WriteTo(buffer[:n], flow.Client); err != nil {
+			slog.Warn("reply failed", "pipe", ml.Name, "client", flow.Client, "sink", flow.Sink, "err", err)
+			return
+		}
+		out.Add(float64(n))
+	}
+}
+
+// idleTimeout of the pipe's flows, the pipe's idle-timeout when set
+func (ml *ManagedListener) idleTimeout() time.Duration {
+	if definition := ml.Definition(); definition.IdleTimeout > 0 {
+		return definition.IdleTimeout
+	}
+	return UDPIdleTimeout
+}
+
+// Expire close flows idle longer than the pipe's idle-timeout or
+// UDPIdleTimeout
+func (ml *ManagedListener) Expire() {
+	var tick = ml.idleTimeout() / 2
+	if tick < time.Millisecond {
+		// a 1ns idle-timeout would tick at 0
+		tick = time.Millisecond
+	}
+	var ticker = time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ml.Done:
+			return
+		case <-ticker.C:
+			var idle []*Flow
+			var timeout = ml.idleTimeout()
+			func() {
+				defer ml.Monitor()()
+				for _, flow := range ml.Flows {
+					if flow.Idle() > timeout {
+						idle = append(idle, flow)
+					}
+				}
+			}()
+			for _, flow := range idle {
+				ml.RemoveFlow(flow)
+			}
+		}
+	}
+}
+
+// ListeningUDP forward datagrams from the managed packet listener
+func (ml *ManagedListener) ListeningUDP() {
+	if ml.PacketConn == nil {
+		slog.Error("no listener", "pipe", ml.Name, "source", ml.Source)
+		return
+	}
+	go ml.Expire()
+	var in = metrics.Bytes.WithLabelValues(ml.Name, "in")
+	var buffer = make([]byte, udpBufferSize)
+	for {
+		n, client, err := ml.PacketConn.ReadFrom(buffer)
+		if err != nil {
+			slog.Warn("read failed", "pipe", ml.Name, "err", err)
+			break
+		}
+		if !ml.Admit(client) {
+			continue
+		}
+		flow, err := ml.Flow(client)
+		if err != nil {
+			slog.Warn("connection failed", "pipe", ml.Name, "client", client, "err", err)
+			continue
+		}
+		flow.Touch()
+		if _, err = flow.SinkConn.Write(buffer[:n]); err != nil {
+			slog.Warn("forward failed", "pipe", ml.Name, "client", client, "sink", flow.Sink, "err", err)
+			ml.RemoveFlow(flow)
+			continue
+		}
+		in.Add(float64(n))
+	}
+}
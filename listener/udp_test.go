@@ -0,0 +1,173 @@
+package listener
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/davidwalter0/forwarder/kubeconfig"
+)
+
+// udpEcho replies to every datagram with the same payload
+func udpEcho(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		var buffer = make([]byte, udpBufferSize)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buffer[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func TestUDPForward(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+
+	ml := NewManagedListener("udp", &PipeDefinition{
+		Source:   "127.0.0.1:0",
+		Sink:     echo.LocalAddr().String(),
+		Protocol: "udp",
+	}, kubeconfig.KubeConfig{})
+	if ml.PacketConn == nil {
+		t.Fatal("udp listener not bound")
+	}
+	ml.Open()
+	defer ml.Close()
+
+	for _, message := range []string{"first", "second"} {
+		client, err := net.Dial("udp", ml.PacketConn.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.SetDeadline(time.Now().Add(time.Second * 5))
+		if _, err = client.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		var buffer = make([]byte, udpBufferSize)
+		n, err := client.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buffer[:n]); got != message {
+			t.Fatalf("Unexpected message:\nGot:\t\t%s\nExpected:\t%s\n", got, message)
+		}
+	}
+
+	unlock := ml.Monitor()
+	defer unlock()
+	if n := len(ml.Flows); n != 2 {
+		t.Errorf("expected 2 flows got %d", n)
+	}
+}
+
+func TestUDPMaxFlows(t *testing.T) {
+	defer func(max int) { MaxFlows = max }(MaxFlows)
+	MaxFlows = 1
+	echo := udpEcho(t)
+	defer echo.Close()
+
+	ml := NewManagedListener("udp", &PipeDefinition{
+		Source:   "127.0.0.1:0",
+		Sink:     echo.LocalAddr().String(),
+		Protocol: "udp",
+	}, kubeconfig.KubeConfig{})
+	ml.Open()
+	defer ml.Close()
+
+	for i, expected := range []bool{true, false} {
+		client, err := net.Dial("udp", ml.PacketConn.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.SetDeadline(time.Now().Add(time.Millisecond * 500))
+		if _, err = client.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.Read(make([]byte, udpBufferSize))
+		if replied := err == nil; replied != expected {
+			t.Errorf("client %d expected a reply %v got %v", i, expected, err)
+		}
+	}
+
+	unlock := ml.Monitor()
+	defer unlock()
+	if n := len(ml.Flows); n != 1 {
+		t.Errorf("expected 1 flow got %d", n)
+	}
+}
+
+func TestUDPSkipsHealth(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+
+	ml := NewManagedListener("udp", &PipeDefinition{
+		Source:      "127.0.0.1:0",
+		Sink:        echo.LocalAddr().String(),
+		Protocol:    "udp",
+		HealthCheck: &HealthCheck{Interval: time.Millisecond * 20, Fall: 1},
+	}, kubeconfig.KubeConfig{})
+	ml.Open()
+	defer ml.Close()
+	// long enough for a tcp check to have marked the sink down
+	time.Sleep(time.Millisecond * 100)
+
+	client, err := net.Dial("udp", ml.PacketConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second * 5))
+	if _, err = client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Read(make([]byte, udpBufferSize)); err != nil {
+		t.Errorf("expected a reply from an unchecked udp sink %v", err)
+	}
+}
+
+func TestUDPTinyIdleTimeout(t *testing.T) {
+	echo := udpEcho(t)
+	defer echo.Close()
+
+	ml := NewManagedListener("udp", &PipeDefinition{
+		Source:      "127.0.0.1:0",
+		Sink:        echo.LocalAddr().String(),
+		Protocol:    "udp",
+		IdleTimeout: time.Nanosecond,
+	}, kubeconfig.KubeConfig{})
+	ml.Open()
+	defer ml.Close()
+
+	client, err := net.Dial("udp", ml.PacketConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err = client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	// flows expire on the clamped tick instead of the ticker panicking
+	var deadline = time.Now().Add(time.Second * 5)
+	for {
+		unlock := ml.Monitor()
+		var n = len(ml.Flows)
+		unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the flow expired, %d open", n)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -0,0 +1,153 @@
+package listener
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UnixScheme prefix of a source or sink that's a unix socket path
+const UnixScheme = "unix://"
+
+// UnixPath of a unix:///path/to.sock address, ok is false for
+// host:port addresses
+func UnixPath(address string) (path string, ok bool) {
+	if strings.HasPrefix(address, UnixScheme) {
+		return strings.TrimPrefix(address, UnixScheme), true
+	}
+	return "", false
+}
+
+// Dial target within timeout, unix:// targets are unix sockets and
+// anything else host:port on network
+func Dial(network, target string, timeout time.Duration) (net.Conn, error) {
+	if path, ok := UnixPath(target); ok {
+		return net.DialTimeout("unix", path, timeout)
+	}
+	return net.DialTimeout(network, target, timeout)
+}
+
+// Socket permissions of a unix socket source, unset fields leave the
+// process's defaults
+type Socket struct {
+	Mode  string `json:"mode"  help:"octal permissions, e.g. 0660"`
+	Owner string `json:"owner" help:"user name or uid owning the socket"`
+	Group string `json:"group" help:"group name or gid owning the socket"`
+}
+
+// SocketEqual compares two socket settings
+func SocketEqual(lhs, rhs *Socket) bool {
+	if lhs == nil || rhs == nil {
+		return lhs == rhs
+	}
+	return *lhs == *rhs
+}
+
+// ParseMode octal permission bits
+func ParseMode(mode string) (os.FileMode, error) {
+	bits, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || bits > 0777 {
+		return 0, fmt.Errorf("mode %q isn't octal permissions 0000-0777", mode)
+	}
+	return os.FileMode(bits), nil
+}
+
+// lookupID numeric id or the id of name
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// Apply mode and ownership to the socket at path
+func (socket *Socket) Apply(path string) error {
+	if socket == nil {
+		return nil
+	}
+	if len(socket.Mode) > 0 {
+		mode, err := ParseMode(socket.Mode)
+		if err != nil {
+			return err
+		}
+		if err = os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if len(socket.Owner) == 0 && len(socket.Group) == 0 {
+		return nil
+	}
+	var uid, gid = -1, -1
+	var err error
+	if len(socket.Owner) > 0 {
+		if uid, err = lookupID(socket.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		}); err != nil {
+			return err
+		}
+	}
+	if len(socket.Group) > 0 {
+		if gid, err = lookupID(socket.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		}); err != nil {
+			return err
+		}
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// ListenUnix open a unix socket listener at path with socket's
+// permissions, a stale socket left by an earlier run is replaced but
+// one still accepting connections isn't
+func ListenUnix(path string, socket *Socket) (listener net.Listener) {
+	var err error
+	for i := 0; i < retries; i++ {
+		if listener, err = listenUnix(path, socket); err != nil {
+			slog.Error("listen failed", "source", UnixScheme+path, "err", err)
+		} else {
+			return listener
+		}
+	}
+	return
+}
+
+// listenUnix one attempt of ListenUnix
+func listenUnix(path string, socket *Socket) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = socket.Apply(path); err != nil {
+		// removes the socket file
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
@@ -0,0 +1,95 @@
+package listener
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/davidwalter0/forwarder/kubeconfig"
+)
+
+// ping address on network expecting the echo back
+func ping(t *testing.T, network, address string) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	fmt.Fprint(conn, "ping")
+	var reply = make([]byte, 4)
+	if _, err = io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("expected ping got %q %v", reply, err)
+	}
+}
+
+func TestUnixSink(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "echo.sock")
+	sink, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	go func() {
+		for {
+			conn, err := sink.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				io.Copy(conn, conn)
+				conn.Close()
+			}(conn)
+		}
+	}()
+	ml := NewManagedListener("docker", &PipeDefinition{
+		Source: "127.0.0.1:0",
+		Sink:   UnixScheme + path,
+	}, kubeconfig.KubeConfig{})
+	ml.Open()
+	defer ml.Close()
+	ping(t, "tcp", ml.Listener.Addr().String())
+}
+
+func TestUnixSource(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+	var path = filepath.Join(t.TempDir(), "forwarder.sock")
+	// a stale socket from an earlier run is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	var definition = &PipeDefinition{
+		Source: UnixScheme + path,
+		Sink:   sink.Addr().String(),
+		Socket: &Socket{Mode: "0600", Owner: fmt.Sprint(os.Getuid()), Group: fmt.Sprint(os.Getgid())},
+	}
+	ml := NewManagedListener("local", definition, kubeconfig.KubeConfig{})
+	if ml.Listener == nil {
+		t.Fatal("expected the stale socket replaced")
+	}
+	ml.Open()
+	ping(t, "unix", path)
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600 got %v %v", info, err)
+	}
+
+	// one still accepting isn't
+	if other := NewManagedListener("other", definition, kubeconfig.KubeConfig{}); other.Listener != nil {
+		other.Close()
+		t.Error("expected a socket in use refused")
+	}
+	ml.Close()
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the socket removed on close %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+// Package logging leveled, structured logs for the forwarder, text or
+// json on stderr with a level that can change while running
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// LevelTrace below debug, also enables the tracer's call traces
+const LevelTrace = slog.LevelDebug - 4
+
+// Level of the default logger, changed at runtime by the admin api
+var Level = new(slog.LevelVar)
+
+// ParseLevel of trace, debug, info, warn or error
+func ParseLevel(text string) (level slog.Level, err error) {
+	if strings.EqualFold(text, "trace") {
+		return LevelTrace, nil
+	}
+	if err = level.UnmarshalText([]byte(text)); err != nil {
+		err = fmt.Errorf("unknown log level %q, expected trace, debug, info, warn or error", text)
+	}
+	return
+}
+
+// LevelName of level as ParseLevel accepts it
+func LevelName(level slog.Level) string {
+	if level == LevelTrace {
+		return "trace"
+	}
+	return strings.ToLower(level.String())
+}
+
+// New logger writing format, text or json, to w at Level
+func New(w io.Writer, format string) (*slog.Logger, error) {
+	var options = &slog.HandlerOptions{Level: Level, ReplaceAttr: replace}
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
+}
+
+// replace names the trace level
+func replace(groups []string, attr slog.Attr) slog.Attr {
+	if attr.Key == slog.LevelKey && len(groups) == 0 {
+		if level, ok := attr.Value.Any().(slog.Level); ok {
+			attr.Value = slog.StringValue(strings.ToUpper(LevelName(level)))
+		}
+	}
+	return attr
+}
+
+// Configure the default logger, and with it the standard log
+// package's output, for format and level
+func Configure(format, level string) error {
+	parsed, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logger, err := New(os.Stderr, format)
+	if err != nil {
+		return err
+	}
+	Level.Set(parsed)
+	slog.SetDefault(logger)
+	return nil
+}
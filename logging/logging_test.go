@@ -0,0 +1,64 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	for text, expected := range map[string]slog.Level{
+		"trace": LevelTrace,
+		"debug": slog.LevelDebug,
+		"INFO":  slog.LevelInfo,
+		"warn":  slog.LevelWarn,
+		"error": slog.LevelError,
+	} {
+		level, err := ParseLevel(text)
+		if err != nil || level != expected {
+			t.Errorf("%s expected %v got %v %v", text, expected, level, err)
+		}
+		if name := LevelName(level); name != strings.ToLower(text) {
+			t.Errorf("expected %s got %s", strings.ToLower(text), name)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("expected an unknown level error")
+	}
+}
+
+func TestNew(t *testing.T) {
+	defer Level.Set(Level.Level())
+	var out bytes.Buffer
+	logger, err := New(&out, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Level.Set(slog.LevelInfo)
+	logger.Debug("hidden")
+	logger.Info("connection failed", "pipe", "web", "sink", "10.0.0.2:80")
+	var record map[string]interface{}
+	if err = json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("expected one json record got %q %v", out.String(), err)
+	}
+	if record["msg"] != "connection failed" || record["pipe"] != "web" || record["sink"] != "10.0.0.2:80" {
+		t.Errorf("unexpected record %v", record)
+	}
+
+	out.Reset()
+	if logger, err = New(&out, "text"); err != nil {
+		t.Fatal(err)
+	}
+	Level.Set(LevelTrace)
+	logger.Log(context.Background(), LevelTrace, "traced", "pipe", "web")
+	if !strings.Contains(out.String(), "level=TRACE msg=traced pipe=web") {
+		t.Errorf("unexpected text %q", out.String())
+	}
+
+	if _, err = New(&out, "xml"); err == nil {
+		t.Error("expected an unknown format error")
+	}
+}
@@ -17,8 +17,11 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/davidwalter0/forwarder/listener"
@@ -45,12 +48,21 @@ var Version string // = strings.Split(string(Load(".version")), "=")[1]
 // ManagedListener control service listening socket + active connections
 type ManagedListener listener.ManagedListener
 
-var complete = make(chan bool)
-
 func main() {
+	if status, ok := subcommand(os.Args[1:]); ok {
+		os.Exit(status)
+	}
 	array := strings.Split(os.Args[0], "/")
 	me := array[len(array)-1]
 	fmt.Printf("%s: Version %s version build %s commit %s\n", me, Version, Build, Commit)
-	mgr.Run()
-	<-complete
+	var signals = make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go mgr.Run()
+	slog.Info("draining", "signal", <-signals)
+	go func() {
+		// a second signal doesn't wait for the drain
+		slog.Info("exiting", "signal", <-signals)
+		os.Exit(1)
+	}()
+	mgr.Shutdown()
 }
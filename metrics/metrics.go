@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// Accepted connections (or udp flows) per pipe name
+	Accepted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "forwarder_accepted_connections_total",
+		Help: "Connections accepted on the pipe's source.",
+	}, []string{"pipe"})
+
+	// Active pipes per pipe name
+	Active = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "forwarder_active_pipes",
+		Help: "Connections currently forwarded by the pipe.",
+	}, []string{"pipe"})
+
+	// DialFailures per pipe name and sink host:port
+	DialFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "forwarder_dial_failures_total",
+		Help: "Failed connection attempts to a sink.",
+	}, []string{"pipe", "sink"})
+
+	// Bytes copied per pipe name, in is client to sink, out is sink to
+	// client
+	Bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "forwarder_bytes_total",
+		Help: "Bytes copied by the pipe in each direction.",
+	}, []string{"pipe", "direction"})
+
+	// Duration of completed connections per pipe name
+	Duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "forwarder_connection_duration_seconds",
+		Help:    "Lifetime of completed connections.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"pipe"})
+
+	// Endpoints resolved per pipe name
+	Endpoints = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "forwarder_endpoints",
+		Help: "Service endpoints currently known to the pipe.",
+	}, []string{"pipe"})
+
+	// Healthy 1 or 0 per pipe name and checked target
+	Healthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "forwarder_target_healthy",
+		Help: "Health check state of a sink or endpoint.",
+	}, []string{"pipe", "target"})
+
+	// Rejected connections per pipe name by the limit that refused them
+	Rejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "forwarder_rejected_connections_total",
+		Help: "Connections refused by a pipe's limits, by reason.",
+	}, []string{"pipe", "reason"})
+
+	// Reloads of pipes.yaml by result, success or failure
+	Reloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "forwarder_config_reloads_total",
+		Help: "Configuration reloads by result.",
+	}, []string{"result"})
+
+	// ConfigValid 1 while the last reload of pipes.yaml was applied, 0
+	// while the previous pipes are kept after a failed reload
+	ConfigValid = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "forwarder_config_valid",
+		Help: "Whether the last configuration reload was applied.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(Accepted, Active, DialFailures, Bytes, Duration, Endpoints, Healthy, Rejected, Reloads, ConfigValid)
+}
+
+// Handler for the /metrics route
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Serve /metrics on address
+func Serve(address string) {
+	var mux = http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	slog.Info("metrics listening", "address", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		slog.Error("metrics failed", "address", address, "err", err)
+	}
+}
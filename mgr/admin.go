@@ -0,0 +1,185 @@
+package mgr
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/davidwalter0/forwarder/listener"
+	"github.com/davidwalter0/forwarder/logging"
+	"github.com/davidwalter0/forwarder/metrics"
+)
+
+// ListenerPipes a listener's status and it's active pipes
+type ListenerPipes struct {
+	listener.ListenerStatus
+	Active []listener.PipeStatus `json:"active"`
+}
+
+// NamedPipeStatus a pipe's status tagged with it's listener name
+type NamedPipeStatus struct {
+	Name string `json:"name"`
+	listener.PipeStatus
+}
+
+// Serve the admin api on address
+//
+//	GET    /listeners         every listener
+//	GET    /listeners/{name}  one listener and it's pipes
+//	DELETE /listeners/{name}  close the listener and it's pipes
+//	GET    /pipes             every active pipe
+//	DELETE /pipes/{id}        close one pipe
+//	GET    /status            the state of the last configuration reload
+//	GET    /loglevel          the current log level
+//	PUT    /loglevel          set the log level from {"level": "debug"}
+//	GET    /metrics           prometheus metrics
+func (mgr *Mgr) Serve(address string) {
+	slog.Info("admin api listening", "address", address)
+	if err := http.ListenAndServe(address, mgr.Handler()); err != nil {
+		slog.Error("admin api failed", "address", address, "err", err)
+	}
+}
+
+// Handler for the admin api routes
+func (mgr *Mgr) Handler() *http.ServeMux {
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/listeners", mgr.listeners)
+	mux.HandleFunc("/listeners/", mgr.listener)
+	mux.HandleFunc("/pipes", mgr.pipes)
+	mux.HandleFunc("/pipes/", mgr.pipe)
+	mux.HandleFunc("/status", mgr.status)
+	mux.HandleFunc("/loglevel", mgr.logLevel)
+	mux.Handle("/metrics", metrics.Handler())
+	return mux
+}
+
+// Lookup a listener by name
+func (mgr *Mgr) Lookup(name string) *listener.ManagedListener {
+	defer mgr.Monitor()()
+	return mgr.Listeners[name]
+}
+
+// Snapshot of the current listeners sorted by name
+func (mgr *Mgr) Snapshot() (listeners []*listener.ManagedListener) {
+	defer mgr.Monitor()()
+	for _, ml := range mgr.Listeners {
+		listeners = append(listeners, ml)
+	}
+	sort.Slice(listeners, func(i, j int) bool { return listeners[i].Name < listeners[j].Name })
+	return
+}
+
+// reply with v as json
+func reply(w http.ResponseWriter, v interface{}) {
+	text, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(text, '\n'))
+}
+
+func (mgr *Mgr) listeners(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var status = []listener.ListenerStatus{}
+	for _, ml := range mgr.Snapshot() {
+		status = append(status, ml.Status())
+	}
+	reply(w, status)
+}
+
+func (mgr *Mgr) listener(w http.ResponseWriter, r *http.Request) {
+	var name = strings.TrimPrefix(r.URL.Path, "/listeners/")
+	var ml = mgr.Lookup(name)
+	if ml == nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		reply(w, ListenerPipes{ListenerStatus: ml.Status(), Active: ml.PipeStatus()})
+	case http.MethodDelete:
+		slog.Info("admin closing listener", "pipe", name)
+		ml.Close()
+		reply(w, ml.Status())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (mgr *Mgr) pipes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var status = []NamedPipeStatus{}
+	for _, ml := range mgr.Snapshot() {
+		for _, pipe := range ml.PipeStatus() {
+			status = append(status, NamedPipeStatus{Name: ml.Name, PipeStatus: pipe})
+		}
+	}
+	reply(w, status)
+}
+
+func (mgr *Mgr) pipe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/pipes/"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, ml := range mgr.Snapshot() {
+		if ml.ClosePipe(id) {
+			slog.Info("admin closed pipe", "pipe", ml.Name, "id", id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (mgr *Mgr) status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reply(w, mgr.Status.Snapshot())
+}
+
+// LogLevel request and reply body for /loglevel
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+func (mgr *Mgr) logLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var request LogLevel
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		level, err := logging.ParseLevel(request.Level)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logging.Level.Set(level)
+		slog.Info("admin set log level", "level", logging.LevelName(level))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reply(w, LogLevel{Level: logging.LevelName(logging.Level.Level())})
+}
@@ -0,0 +1,198 @@
+package mgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidwalter0/forwarder/kubeconfig"
+	"github.com/davidwalter0/forwarder/listener"
+	"github.com/davidwalter0/forwarder/logging"
+)
+
+// echo server copying every connection back to itself
+func echo(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				io.Copy(conn, conn)
+				conn.Close()
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func get(t *testing.T, url string, v interface{}) {
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if err = json.NewDecoder(response.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+
+	var mgr = Mgr{Listeners: make(map[string]*listener.ManagedListener)}
+	ml := listener.NewManagedListener("echo", &listener.PipeDefinition{
+		Source: "127.0.0.1:0",
+		Sink:   sink.Addr().String(),
+	}, kubeconfig.KubeConfig{})
+	ml.Open()
+	defer ml.Close()
+	mgr.Listeners["echo"] = ml
+
+	server := httptest.NewServer(mgr.Handler())
+	defer server.Close()
+
+	client, err := net.Dial("tcp", ml.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second * 5))
+	fmt.Fprint(client, "ping")
+	if _, err = io.ReadFull(client, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	var listeners []listener.ListenerStatus
+	get(t, server.URL+"/listeners", &listeners)
+	if len(listeners) != 1 || listeners[0].Name != "echo" || !listeners[0].Bound || listeners[0].Pipes != 1 {
+		t.Fatalf("unexpected listeners %+v", listeners)
+	}
+
+	var pipes []NamedPipeStatus
+	get(t, server.URL+"/pipes", &pipes)
+	if len(pipes) != 1 || pipes[0].Name != "echo" || pipes[0].BytesIn != 4 || pipes[0].BytesOut != 4 {
+		t.Fatalf("unexpected pipes %+v", pipes)
+	}
+
+	request, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/pipes/%d", server.URL, pipes[0].ID), nil)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		t.Fatalf("close pipe status %d", response.StatusCode)
+	}
+	if _, err = client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected closed pipe got %v", err)
+	}
+
+	request, _ = http.NewRequest(http.MethodDelete, server.URL+"/listeners/echo", nil)
+	if response, err = http.DefaultClient.Do(request); err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	var status ListenerPipes
+	get(t, server.URL+"/listeners/echo", &status)
+	if status.Bound {
+		t.Fatalf("listener still bound %+v", status)
+	}
+}
+
+// TestAdminConcurrent admin requests racing pipes that open and close
+func TestAdminConcurrent(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+
+	var mgr = Mgr{Listeners: make(map[string]*listener.ManagedListener)}
+	ml := listener.NewManagedListener("echo", &listener.PipeDefinition{
+		Source: "127.0.0.1:0",
+		Sink:   sink.Addr().String(),
+	}, kubeconfig.KubeConfig{})
+	ml.Open()
+	defer ml.Close()
+	mgr.Listeners["echo"] = ml
+	var handler = mgr.Handler()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				client, err := net.Dial("tcp", ml.Listener.Addr().String())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				client.SetDeadline(time.Now().Add(time.Second * 5))
+				fmt.Fprint(client, "ping")
+				io.ReadFull(client, make([]byte, 4))
+				client.Close()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				for _, path := range []string{"/listeners", "/listeners/echo", "/pipes"} {
+					handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+				}
+				var recorder = httptest.NewRecorder()
+				handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/pipes", nil))
+				var pipes []NamedPipeStatus
+				json.NewDecoder(recorder.Body).Decode(&pipes)
+				for _, pipe := range pipes {
+					handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/pipes/%d", pipe.ID), nil))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	defer logging.Level.Set(logging.Level.Level())
+	var mgr = Mgr{Listeners: make(map[string]*listener.ManagedListener)}
+	server := httptest.NewServer(mgr.Handler())
+	defer server.Close()
+
+	var level LogLevel
+	get(t, server.URL+"/loglevel", &level)
+	if level.Level != "info" {
+		t.Fatalf("expected info got %+v", level)
+	}
+	for body, expected := range map[string]int{
+		`{"level": "debug"}`:   http.StatusOK,
+		`{"level": "verbose"}`: http.StatusBadRequest,
+		`debug`:                http.StatusBadRequest,
+	} {
+		request, _ := http.NewRequest(http.MethodPut, server.URL+"/loglevel", strings.NewReader(body))
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != expected {
+			t.Errorf("%s expected %d got %d", body, expected, response.StatusCode)
+		}
+	}
+	get(t, server.URL+"/loglevel", &level)
+	if level.Level != "debug" || logging.Level.Level() != slog.LevelDebug {
+		t.Errorf("expected debug got %+v", level)
+	}
+}
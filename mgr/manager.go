@@ -16,15 +16,19 @@
 package mgr
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"os"
 	"time"
 
 	"github.com/davidwalter0/forwarder/kubeconfig"
 	"github.com/davidwalter0/forwarder/listener"
+	"github.com/davidwalter0/forwarder/logging"
+	"github.com/davidwalter0/forwarder/metrics"
 	"github.com/davidwalter0/forwarder/set"
 	"github.com/davidwalter0/forwarder/tracer"
 	"github.com/davidwalter0/go-cfg"
@@ -68,6 +72,8 @@ var pipeDefs *map[string]*listener.PipeDefinition
 type Mgr struct {
 	Listeners map[string]*listener.ManagedListener
 	Mutex     mutex.Mutex
+	Status    Status
+	stopped   bool
 }
 
 // Monitor lifts mutex deferable lock to Mgr object
@@ -76,63 +82,62 @@ func (mgr *Mgr) Monitor() func() {
 	return mgr.Mutex.Monitor()
 }
 
-// Monitor lifts mutex deferable lock to Mgr object
-func (mgr *Mgr) LoadEndpoints() {
-	for k, v := range mgr.Listeners {
-		if v != nil {
-			if v.EnableEp {
-				v.Endpoints = kubeconfig.Endpoints(v.Service, v.Namespace)
-				if kubeConfig.Debug {
-					log.Println("mgr", k, v.Service, v.Namespace, v.Endpoints, v.Source, v.Sink)
-				}
-			}
-		}
-	}
-}
-
 // Run primary processing loop
 func (mgr *Mgr) Run() {
 	Configure()
 	mgr.Listeners = make(map[string]*listener.ManagedListener)
-	// defer trace.Tracer.Detailed(trace.Detail).Enable(trace.Enabled).ScopedTrace()()
-	{
-		var m = make(map[string]*listener.PipeDefinition)
-		mgr.Merge(&m)
+	if len(kubeConfig.Admin) > 0 {
+		go mgr.Serve(kubeConfig.Admin)
+	}
+	if len(kubeConfig.Metrics) > 0 && kubeConfig.Metrics != kubeConfig.Admin {
+		go metrics.Serve(kubeConfig.Metrics)
 	}
+	// defer trace.Tracer.Detailed(trace.Detail).Enable(trace.Enabled).ScopedTrace()()
+	// pipeDefs tracks the running set, an invalid file leaves it as is
+	pipeDefs = &map[string]*listener.PipeDefinition{}
+	mgr.Merge(pipeDefs)
 	go Watch()
-	var pipeDefs = LoadEndPts()
 	for {
 		{
-			if kubeConfig.Debug {
-				log.Println("Loop in Run()")
-			}
+			slog.Log(context.Background(), logging.LevelTrace, "loop in Run()")
 			select {
 			case stat := <-reload:
 				// defer trace.Tracer.Enable(trace.Enabled).ScopedTrace(fmt.Sprintf("Reload %v %v", stat.Name(), stat.ModTime()))()
-				if kubeConfig.Debug {
-					log.Printf("Reload %v %v\n", stat.Name(), stat.ModTime())
-				}
+				slog.Debug("reload", "file", stat.Name(), "modified", stat.ModTime())
 				mgr.Merge(pipeDefs)
 			case delay := <-time.After(time.Second * logReloadTimeout):
-				if kubeConfig.Debug {
-					log.Printf("Reload timed out after %d seconds %v\n", logReloadTimeout, delay)
-				}
+				slog.Debug("reload timed out", "seconds", int64(logReloadTimeout), "at", delay)
 			}
 		}
 	}
 }
 
-// Merge the kubeConfiguration of pipeDefs
-func (mgr *Mgr) Merge(lhs *map[string]*listener.PipeDefinition) {
+// Merge the kubeConfiguration file into the running pipeDefs in lhs,
+// when the file can't be loaded or is invalid the running pipes are
+// left untouched and the error is returned
+func (mgr *Mgr) Merge(lhs *map[string]*listener.PipeDefinition) error {
 	defer mgr.Monitor()()
 	defer trace.Tracer.Detailed(trace.Detail).Enable(trace.Enabled).ScopedTrace()()
-	rhs := LoadEndPts()
+	if mgr.stopped {
+		return fmt.Errorf("shutting down")
+	}
+	rhs, err := LoadEndPts()
+	if err == nil {
+		err = Validate(rhs)
+	}
+	mgr.Status.Reloaded(err)
+	if err != nil {
+		slog.Error("reload failed, keeping running pipes", "file", kubeConfig.File, "pipes", len(*lhs), "err", err)
+		metrics.Reloads.WithLabelValues("failure").Inc()
+		metrics.ConfigValid.Set(0)
+		return err
+	}
 	var LOnly, Common, ROnly = set.Difference(lhs, rhs)
 	// Not Common or in the right hand (new kubeConfig) set, are now
 	// vestiges of the prior (lhs) set
 	for _, k := range LOnly {
 		{
-			log.Println("closing lhs[k]", k, (*lhs)[k])
+			slog.Info("removed", "pipe", k, "source", (*lhs)[k].Source)
 			mgr.Listeners[k].Close()
 			delete((*lhs), k)
 			delete(mgr.Listeners, k)
@@ -142,29 +147,80 @@ func (mgr *Mgr) Merge(lhs *map[string]*listener.PipeDefinition) {
 	// If Common names were updated, replace with new kubeConfig
 	for _, k := range Common {
 		{
-			log.Println("common lhs[k]", k, (*lhs)[k], "equal", !(*lhs)[k].Equal((*rhs)[k]))
+			slog.Debug("common", "pipe", k, "source", (*lhs)[k].Source, "changed", !(*lhs)[k].Equal((*rhs)[k]))
 			if !(*lhs)[k].Equal((*rhs)[k]) {
+				// same source, keep it bound and the active pipes open
+				if mgr.Listeners[k].Bound() && (*lhs)[k].BindEqual((*rhs)[k]) {
+					err := mgr.Listeners[k].Update((*rhs)[k])
+					if err == nil {
+						(*lhs)[k] = listener.NewPipeDefinition((*rhs)[k])
+						continue
+					}
+					slog.Info("rebinding", "pipe", k, "source", (*rhs)[k].Source, "err", err)
+				}
 				mgr.Listeners[k].Close()
 				delete((*lhs), k)
 				delete(mgr.Listeners, k)
-				mgr.Listeners[k] = NewManagedListener((*rhs)[k], kubeConfig)
+				mgr.Listeners[k] = NewManagedListener(k, (*rhs)[k], kubeConfig)
 				(*lhs)[k] = listener.NewPipeDefinition((*rhs)[k])
 				mgr.Listeners[k].Open()
+				mgr.Listeners[k].WatchEndpoints()
 			}
 		}
 	}
 
 	// Add new items (not in L, existing)
 	for _, k := range ROnly {
-		log.Println("right only rhs[k]", k, (*rhs)[k])
+		slog.Info("added", "pipe", k, "source", (*rhs)[k].Source, "sink", (*rhs)[k].Sink, "service", (*rhs)[k].Service)
 		(*lhs)[k] = listener.NewPipeDefinition((*rhs)[k])
-		mgr.Listeners[k] = NewManagedListener((*rhs)[k], kubeConfig)
+		mgr.Listeners[k] = NewManagedListener(k, (*rhs)[k], kubeConfig)
 		mgr.Listeners[k].Open()
+		mgr.Listeners[k].WatchEndpoints()
+	}
+	metrics.Reloads.WithLabelValues("success").Inc()
+	metrics.ConfigValid.Set(1)
+	return nil
+}
+
+// drainPoll interval between checks for pipes still active
+var drainPoll = time.Millisecond * 100
+
+// Shutdown stop accepting on every listener, wait up to the drain
+// period for active pipes to finish, then close the rest
+func (mgr *Mgr) Shutdown() {
+	var listeners []*listener.ManagedListener
+	func() {
+		defer mgr.Monitor()()
+		mgr.stopped = true
+		for _, ml := range mgr.Listeners {
+			listeners = append(listeners, ml)
+		}
+	}()
+	for _, ml := range listeners {
+		ml.Stop()
+	}
+	var deadline = time.Now().Add(kubeConfig.Drain)
+	for {
+		var active int
+		for _, ml := range listeners {
+			active += ml.Active()
+		}
+		if active == 0 {
+			slog.Info("shutdown drained")
+			break
+		}
+		if time.Now().After(deadline) {
+			slog.Warn("shutdown closing active pipes", "active", active, "drain", kubeConfig.Drain)
+			break
+		}
+		time.Sleep(drainPoll)
 	}
-	mgr.LoadEndpoints()
+	for _, ml := range listeners {
+		ml.Close()
+	}
+	listener.Access.Close()
 }
 
-var complete = make(chan bool)
 var counter uint64
 
 // CheckInCluster reports if the env variable is set for cluster
@@ -180,6 +236,9 @@ func Configure() {
 	if err = cfg.Process("", &kubeConfig); err != nil {
 		log.Fatalf("Error: %v", err)
 	}
+	if err = logging.Configure(kubeConfig.LogFormat, kubeConfig.Level()); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
 
 	if len(kubeConfig.File) == 0 {
 		fmt.Println("Error: kubeConfiguration file not set")
@@ -188,99 +247,104 @@ func Configure() {
 	}
 
 	var jsonText []byte
-	jsonText, _ = json.MarshalIndent(&kubeConfig, "", "  ")
-	if kubeConfig.Debug {
-		fmt.Printf("\n%v\n", string(jsonText))
-	}
+	jsonText, _ = json.Marshal(&kubeConfig)
+	slog.Debug("configuration", "options", json.RawMessage(jsonText))
 	kubeConfig.LoadKubeConfig()
-	trace.Enabled = kubeConfig.Debug
+	// set at startup only, the tracer isn't safe to switch while running
+	trace.Enabled = logging.Level.Level() <= logging.LevelTrace
+	if len(kubeConfig.AccessLog) > 0 {
+		listener.Access, err = listener.NewAccessLog(kubeConfig.AccessLog, kubeConfig.AccessFormat,
+			kubeConfig.AccessSize, kubeConfig.AccessKeep, kubeConfig.AccessAge)
+		if err != nil {
+			slog.Error("accessformat", "err", err)
+			os.Exit(1)
+		}
+	}
 }
 
 // LoadEndPts load from text into a pipeDefs object
-func LoadEndPts() (e *map[string]*listener.PipeDefinition) {
+func LoadEndPts() (e *map[string]*listener.PipeDefinition, err error) {
+	var text []byte
+	if text, err = Load(kubeConfig.File); err != nil {
+		return
+	}
+	return Parse(text, false)
+}
+
+// Parse yaml text into a pipeDefs object, strict rejects keys that
+// aren't pipe definition fields
+func Parse(text []byte, strict bool) (e *map[string]*listener.PipeDefinition, err error) {
 	var m = make(map[string]*listener.PipeDefinition)
 	e = &m
-	var text = Load(kubeConfig.File)
-	var err = yaml.Unmarshal(text, e)
-	if err != nil {
-		log.Fatalf("error: %v", err)
+	var unmarshal = yaml.Unmarshal
+	if strict {
+		unmarshal = yaml.UnmarshalStrict
 	}
-
-	if err != nil {
-		log.Fatalf("error: %v", err)
+	if err = unmarshal(text, e); err != nil {
+		return nil, err
 	}
 	return
 }
 
 // Load helper function from file to []byte
-func Load(filename string) []byte {
+func Load(filename string) ([]byte, error) {
 	if len(filename) == 0 {
 		panic(fmt.Sprintf("Can't Load() a file with an empty name"))
 	}
-
-	var err error
-	var text []byte
-	if len(filename) > 0 {
-		text, err = ioutil.ReadFile(filename)
-		if err != nil {
-			log.Printf("%v\n", err)
-			os.Exit(3)
-		}
-	}
-	return text
+	return ioutil.ReadFile(filename)
 }
 
 // Watch reports file change
 func Watch() {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("watch failed", "file", kubeConfig.File, "err", err)
+		os.Exit(1)
 	}
-	go func() {
-		for {
-			// Secret update -> REMOVE event, invalidates the watch,
-			// reassert
-			err = watcher.Add(kubeConfig.File)
+	defer watcher.Close()
+	watch(watcher, kubeConfig.File, reload, nil)
+}
+
+// watch file sending its stat on changes until done closes
+func watch(watcher *fsnotify.Watcher, file string, changes chan<- os.FileInfo, done <-chan bool) {
+	// stale while the file's missing, at startup or after a change
+	// whose stat failed, it's back when the watch can be added again
+	var stale bool
+	for {
+		// Secret update -> REMOVE event, invalidates the watch,
+		// reassert
+		if err := watcher.Add(file); err != nil {
+			slog.Error("watch failed", "file", file, "err", err)
+			stale = true
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Second * 3):
+			}
+			continue
+		}
+		if stale {
+			if stat, err := os.Stat(file); err == nil {
+				stale = false
+				slog.Info("changed", "file", file, "op", "restored", "modified", stat.ModTime())
+				changes <- stat
+			}
+		}
+		select {
+		case <-done:
+			return
+		case event := <-watcher.Events:
+			stat, err := os.Stat(file)
 			if err != nil {
-				log.Println(err)
-				time.Sleep(time.Second * 3)
-			} else {
-				select {
-				case event := <-watcher.Events:
-					stat, err := os.Stat(kubeConfig.File)
-					reload <- stat
-					msg := fmt.Sprintf("Reload %v %v", stat.Name(), stat.ModTime())
-					if err == nil {
-						log.Printf("stat %v %v %v\n", event.Name, msg, err)
-					} else {
-						log.Printf("stat %v %v %v\n", event.Name, msg, err)
-					}
-					op := event.Op
-					if op&fsnotify.Create == fsnotify.Create {
-						log.Println("CREATE", event.Name, msg)
-					}
-					if op&fsnotify.Remove == fsnotify.Remove {
-						log.Println("REMOVE", event.Name, msg)
-					}
-					if op&fsnotify.Write == fsnotify.Write {
-						log.Println("WRITE", event.Name, msg)
-					}
-					if op&fsnotify.Rename == fsnotify.Rename {
-						log.Println("RENAME", event.Name, msg)
-					}
-					if op&fsnotify.Chmod == fsnotify.Chmod {
-						log.Println("CHMOD", event.Name, msg)
-					}
-				case err := <-watcher.Errors:
-					stat, e := os.Stat(kubeConfig.File)
-					msg := fmt.Sprintf("watch error %v %v %v %v", err, stat.Name(), stat.ModTime(), e)
-					log.Println("error:", msg)
-				}
+				// removed mid update, reload when it's back
+				slog.Warn("stat failed", "file", event.Name, "err", err)
+				stale = true
+				continue
 			}
+			changes <- stat
+			slog.Info("changed", "file", event.Name, "op", event.Op.String(), "modified", stat.ModTime())
+		case err := <-watcher.Errors:
+			slog.Error("watch failed", "file", file, "err", err)
 		}
-	}()
-
-	defer watcher.Close()
-	done := make(chan bool)
-	<-done
+	}
 }
@@ -0,0 +1,286 @@
+package mgr
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/davidwalter0/forwarder/kubeconfig"
+	"github.com/davidwalter0/forwarder/listener"
+	"github.com/fsnotify/fsnotify"
+)
+
+// TestMergeKeepsLastGood an invalid reload leaves the running pipes
+func TestMergeKeepsLastGood(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwarder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kubeConfig.File = filepath.Join(dir, "pipes.yaml")
+	write := func(text string) {
+		if err := ioutil.WriteFile(kubeConfig.File, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mgr = Mgr{Listeners: make(map[string]*listener.ManagedListener)}
+	var pipes = &map[string]*listener.PipeDefinition{}
+	defer func() {
+		for _, ml := range mgr.Listeners {
+			ml.Close()
+		}
+	}()
+
+	write("echo:\n  source: 127.0.0.1:0\n  sink: 127.0.0.1:1\n")
+	if err = mgr.Merge(pipes); err != nil {
+		t.Fatal(err)
+	}
+	if len(*pipes) != 1 || mgr.Status.Snapshot().Generation != 1 {
+		t.Fatalf("expected one pipe at generation 1 got %d %+v", len(*pipes), mgr.Status.Snapshot())
+	}
+	var running = mgr.Listeners["echo"]
+
+	for _, text := range []string{
+		"echo: [not a pipe",
+		"echo:\n  source: 127.0.0.1:0\n",
+		"echo:\n  source: 127.0.0.1:0\n  sink: 127.0.0.1:1\n  balance: fastest\n",
+	} {
+		write(text)
+		if err = mgr.Merge(pipes); err == nil {
+			t.Errorf("%q expected error", text)
+		}
+		status := mgr.Status.Snapshot()
+		if status.Valid || len(status.Error) == 0 || status.Generation != 1 {
+			t.Errorf("%q status %+v", text, status)
+		}
+		if mgr.Listeners["echo"] != running || len(*pipes) != 1 {
+			t.Errorf("%q replaced the running pipes", text)
+		}
+	}
+
+	os.Remove(kubeConfig.File)
+	if err = mgr.Merge(pipes); err == nil || mgr.Listeners["echo"] != running {
+		t.Error("expected missing file to keep the running pipes")
+	}
+}
+
+// TestShutdown active pipes keep working through the drain and are
+// closed after it, new connections are refused
+func TestShutdown(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+	kubeConfig.Drain = time.Millisecond * 500
+	defer func() { kubeConfig.Drain = 0 }()
+
+	var mgr = Mgr{Listeners: make(map[string]*listener.ManagedListener)}
+	ml := listener.NewManagedListener("echo", &listener.PipeDefinition{
+		Source: "127.0.0.1:0",
+		Sink:   sink.Addr().String(),
+	}, kubeconfig.KubeConfig{})
+	ml.Open()
+	mgr.Listeners["echo"] = ml
+	var source = ml.Listener.Addr().String()
+
+	conn, err := net.Dial("tcp", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	var reply = make([]byte, 4)
+	conn.Write([]byte("ping"))
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	var start = time.Now()
+	var done = make(chan bool)
+	go func() {
+		mgr.Shutdown()
+		close(done)
+	}()
+	time.Sleep(time.Millisecond * 100)
+	if refused, err := net.Dial("tcp", source); err == nil {
+		refused.Close()
+		t.Error("expected new connections to be refused while draining")
+	}
+	conn.Write([]byte("pong"))
+	if _, err = io.ReadFull(conn, reply); err != nil || string(reply) != "pong" {
+		t.Fatalf("expected the active pipe to work while draining %q %v", reply, err)
+	}
+	<-done
+	if elapsed := time.Since(start); elapsed < kubeConfig.Drain {
+		t.Errorf("shutdown returned after %v before the drain period", elapsed)
+	}
+	if _, err = conn.Read(reply); err == nil {
+		t.Error("expected the active pipe to be closed after the drain")
+	}
+	if mgr.Merge(&map[string]*listener.PipeDefinition{}) == nil {
+		t.Error("expected no reloads after shutdown")
+	}
+}
+
+// TestShutdownDrained returns as soon as the last pipe finishes
+func TestShutdownDrained(t *testing.T) {
+	sink := echo(t)
+	defer sink.Close()
+	kubeConfig.Drain = time.Second * 10
+	defer func() { kubeConfig.Drain = 0 }()
+
+	var mgr = Mgr{Listeners: make(map[string]*listener.ManagedListener)}
+	ml := listener.NewManagedListener("echo", &listener.PipeDefinition{
+		Source: "127.0.0.1:0",
+		Sink:   sink.Addr().String(),
+	}, kubeconfig.KubeConfig{})
+	ml.Open()
+	mgr.Listeners["echo"] = ml
+
+	conn, err := net.Dial("tcp", ml.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+	io.ReadFull(conn, make([]byte, 4))
+	time.AfterFunc(time.Millisecond*200, func() { conn.Close() })
+
+	var start = time.Now()
+	mgr.Shutdown()
+	if elapsed := time.Since(start); elapsed > time.Second*5 {
+		t.Errorf("shutdown waited %v after the last pipe closed", elapsed)
+	}
+}
+
+// TestMergeUpdate a sink change keeps the listener, a source change
+// replaces it
+func TestMergeUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forwarder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kubeConfig.File = filepath.Join(dir, "pipes.yaml")
+	write := func(text string) {
+		if err := ioutil.WriteFile(kubeConfig.File, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mgr = Mgr{Listeners: make(map[string]*listener.ManagedListener)}
+	var pipes = &map[string]*listener.PipeDefinition{}
+	defer func() {
+		for _, ml := range mgr.Listeners {
+			ml.Close()
+		}
+	}()
+
+	write("echo:\n  source: 127.0.0.1:0\n  sink: 127.0.0.1:1\n")
+	if err = mgr.Merge(pipes); err != nil {
+		t.Fatal(err)
+	}
+	var running = mgr.Listeners["echo"]
+
+	write("echo:\n  source: 127.0.0.1:0\n  sink: 127.0.0.1:2\n  balance: least-connections\n")
+	if err = mgr.Merge(pipes); err != nil {
+		t.Fatal(err)
+	}
+	if mgr.Listeners["echo"] != running || !running.Bound() || running.Status().Sink != "127.0.0.1:2" {
+		t.Fatal("expected the sink updated in place")
+	}
+	if (*pipes)["echo"].Sink != "127.0.0.1:2" {
+		t.Errorf("expected the running definition updated got %s", (*pipes)["echo"].Sink)
+	}
+
+	write("echo:\n  source: 127.0.0.2:0\n  sink: 127.0.0.1:2\n")
+	if err = mgr.Merge(pipes); err != nil {
+		t.Fatal(err)
+	}
+	if mgr.Listeners["echo"] == running || running.Bound() {
+		t.Fatal("expected a source change to rebind")
+	}
+}
+
+// TestWatchReplaced a config replaced by rename or by remove then
+// create is reported
+func TestWatchReplaced(t *testing.T) {
+	var file = filepath.Join(t.TempDir(), "pipes.yaml")
+	if err := ioutil.WriteFile(file, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	var changes = make(chan os.FileInfo, 16)
+	var done = make(chan bool)
+	defer close(done)
+	go watch(watcher, file, changes, done)
+	// the watch is added before the first change
+	time.Sleep(time.Millisecond * 100)
+
+	changed := func(size int64) {
+		t.Helper()
+		var timeout = time.After(time.Second * 10)
+		for {
+			select {
+			case stat := <-changes:
+				if stat.Size() == size {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("expected a change to a %d byte file", size)
+			}
+		}
+	}
+
+	var next = file + ".next"
+	if err = ioutil.WriteFile(next, []byte("{ }"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(next, file); err != nil {
+		t.Fatal(err)
+	}
+	changed(3)
+
+	if err = os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if err = ioutil.WriteFile(file, []byte("{  }"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	changed(4)
+}
+
+// TestWatchMissing a config missing when the watch starts is reported
+// once it's created
+func TestWatchMissing(t *testing.T) {
+	var file = filepath.Join(t.TempDir(), "pipes.yaml")
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	var changes = make(chan os.FileInfo, 16)
+	var done = make(chan bool)
+	defer close(done)
+	go watch(watcher, file, changes, done)
+	time.Sleep(time.Millisecond * 100)
+
+	if err = ioutil.WriteFile(file, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case stat := <-changes:
+		if stat.Size() != 2 {
+			t.Errorf("expected a 2 byte file got %d", stat.Size())
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("expected the created file reported")
+	}
+}
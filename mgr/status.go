@@ -0,0 +1,47 @@
+package mgr
+
+import (
+	"sync"
+	"time"
+)
+
+// ReloadStatus the outcome of the most recent configuration reloads
+type ReloadStatus struct {
+	File       string    `json:"file"`
+	Generation uint64    `json:"generation"`
+	Applied    time.Time `json:"applied"`
+	Attempted  time.Time `json:"attempted"`
+	Valid      bool      `json:"valid"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Status of configuration reloads, Generation counts the reloads that
+// were applied, a failed reload records it's error and leaves the
+// running Generation as is
+type Status struct {
+	mutex  sync.Mutex
+	status ReloadStatus
+}
+
+// Reloaded record the result of a reload attempt
+func (s *Status) Reloaded(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status.File = kubeConfig.File
+	s.status.Attempted = time.Now()
+	s.status.Valid = err == nil
+	s.status.Error = ""
+	if err != nil {
+		s.status.Error = err.Error()
+		return
+	}
+	s.status.Generation++
+	s.status.Applied = s.status.Attempted
+}
+
+// Snapshot copy of the current status
+func (s *Status) Snapshot() ReloadStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.status
+}
@@ -0,0 +1,294 @@
+package mgr
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidwalter0/forwarder/listener"
+)
+
+// privilegedPort sources below this need root or CAP_NET_BIND_SERVICE
+const privilegedPort = 1024
+
+// ValidationErrors every problem found in a set of pipe definitions
+type ValidationErrors []error
+
+// Error text of all the errors, one per line
+func (errs ValidationErrors) Error() string {
+	var text []string
+	for _, err := range errs {
+		text = append(text, err.Error())
+	}
+	return strings.Join(text, "\n")
+}
+
+// PipeError a problem with one named pipe definition, warnings are
+// reported but don't stop the pipes being applied
+type PipeError struct {
+	Name    string `json:"name"`
+	Field   string `json:"field"`
+	Err     error  `json:"-"`
+	Warning bool   `json:"warning,omitempty"`
+}
+
+// Error text naming the pipe and field
+func (err *PipeError) Error() string {
+	if err.Warning {
+		return fmt.Sprintf("%s: %s: warning: %v", err.Name, err.Field, err.Err)
+	}
+	return fmt.Sprintf("%s: %s: %v", err.Name, err.Field, err.Err)
+}
+
+// Validate the pipe definitions, nil when they can be applied
+func Validate(pipes *map[string]*listener.PipeDefinition) error {
+	var errs ValidationErrors
+	for _, err := range Check(pipes) {
+		if !err.Warning {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Check every pipe definition and the set as a whole, returning errors
+// and warnings sorted by pipe name
+func Check(pipes *map[string]*listener.PipeDefinition) (errs []*PipeError) {
+	var names []string
+	for name := range *pipes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		errs = append(errs, ValidatePipe(name, (*pipes)[name])...)
+	}
+	return append(errs, duplicates(names, pipes)...)
+}
+
+// ValidatePipe check one pipe definition
+func ValidatePipe(name string, pipe *listener.PipeDefinition) (errs []*PipeError) {
+	var fail = func(field, format string, args ...interface{}) {
+		errs = append(errs, &PipeError{Name: name, Field: field, Err: fmt.Errorf(format, args...)})
+	}
+	if pipe == nil {
+		fail("pipe", "empty definition")
+		return
+	}
+	if len(pipe.Source) == 0 {
+		fail("source", "required")
+	} else if path, ok := listener.UnixPath(pipe.Source); ok {
+		if err := unixPath(path); err != nil {
+			fail("source", "%v", err)
+		}
+		if pipe.IsUDP() {
+			fail("protocol", "udp can't use a unix socket source")
+		}
+		if len(pipe.SNI) > 0 {
+			fail("sni", "unix socket sources aren't routed by sni")
+		}
+	} else if port, err := hostPort(pipe.Source); err != nil {
+		fail("source", "%v", err)
+	} else if port > 0 && port < privilegedPort {
+		errs = append(errs, &PipeError{Name: name, Field: "source", Warning: true,
+			Err: fmt.Errorf("privileged port %d needs root or CAP_NET_BIND_SERVICE", port)})
+	}
+	switch {
+	case len(pipe.Sink) == 0 && len(pipe.Service) == 0:
+		fail("sink", "a sink or service is required")
+	case len(pipe.Sink) > 0:
+		if len(pipe.Service) > 0 {
+			errs = append(errs, &PipeError{Name: name, Field: "sink", Warning: true,
+				Err: fmt.Errorf("sink and service are both set, the sink is used until the service has endpoints")})
+		}
+		if path, ok := listener.UnixPath(pipe.Sink); ok {
+			if err := unixPath(path); err != nil {
+				fail("sink", "%v", err)
+			}
+			if pipe.IsUDP() {
+				fail("protocol", "udp can't forward to a unix socket sink")
+			}
+		} else if port, err := hostPort(pipe.Sink); err != nil {
+			fail("sink", "%v", err)
+		} else if port == 0 {
+			fail("sink", "port 0 in %q", pipe.Sink)
+		}
+	}
+	if pipe.Socket != nil {
+		if _, ok := listener.UnixPath(pipe.Source); !ok {
+			fail("socket", "needs a unix:// source")
+		}
+		if len(pipe.Socket.Mode) > 0 {
+			if _, err := listener.ParseMode(pipe.Socket.Mode); err != nil {
+				fail("socket", "%v", err)
+			}
+		}
+	}
+	if pipe.EnableEp && (len(pipe.Service) == 0 || len(pipe.Namespace) == 0) {
+		fail("enableep", "needs both service and namespace")
+	}
+	if _, err := listener.NewBalancer(pipe.Balance, pipe.Weights); err != nil {
+		fail("balance", "%v", err)
+	}
+	if hc := pipe.HealthCheck; hc != nil {
+		switch hc.Type {
+		case "", "tcp", "http":
+		case "send-expect":
+			if len(hc.Expect) == 0 {
+				fail("health", "send-expect needs expect")
+			}
+		default:
+			fail("health", "unknown type %q, expected tcp, send-expect or http", hc.Type)
+		}
+		if hc.Interval < 0 || hc.Timeout < 0 || hc.Rise < 0 || hc.Fall < 0 {
+			fail("health", "negative interval, timeout, rise or fall %+v", *hc)
+		}
+	}
+	for _, timeout := range []struct {
+		field    string
+		duration time.Duration
+	}{
+		{"connect-timeout", pipe.ConnectTimeout},
+		{"idle-timeout", pipe.IdleTimeout},
+		{"max-lifetime", pipe.MaxLifetime},
+		{"queue-timeout", pipe.QueueTimeout},
+	} {
+		if timeout.duration < 0 {
+			fail(timeout.field, "negative duration %v", timeout.duration)
+		}
+	}
+	if pipe.MaxConnections < 0 {
+		fail("max-connections", "negative %d", pipe.MaxConnections)
+	}
+	if pipe.MaxPerClient < 0 {
+		fail("max-connections-per-client", "negative %d", pipe.MaxPerClient)
+	}
+	for _, list := range []struct {
+		field string
+		cidrs []string
+	}{{"allow", pipe.Allow}, {"deny", pipe.Deny}, {"trusted-proxies", pipe.TrustedProxies}} {
+		for _, cidr := range list.cidrs {
+			if _, err := listener.ParseCIDR(cidr); err != nil {
+				fail(list.field, "%v", err)
+			}
+		}
+	}
+	if b := pipe.Bandwidth; b != nil && (b.Rate < 0 || b.Burst < 0 || b.ClientRate < 0 || b.ClientBurst < 0) {
+		fail("bandwidth", "negative rate or burst %+v", *b)
+	}
+	if r := pipe.ConnectionRate; r != nil && (r.Rate <= 0 || r.Burst < 0 || r.BanAfter < 0 || r.BanDuration < 0) {
+		fail("connection-rate", "rate must be positive, burst, ban-after and ban-duration not negative %+v", *r)
+	}
+	if pipe.AcceptProxyProtocol && len(pipe.SNI) > 0 {
+		fail("accept-proxy-protocol", "not available on sni pipes, they route on the ClientHello before a header could be read")
+	}
+	switch {
+	case len(pipe.TrustedProxies) > 0 && !pipe.AcceptProxyProtocol:
+		fail("trusted-proxies", "needs accept-proxy-protocol")
+	case pipe.AcceptProxyProtocol && len(pipe.TrustedProxies) == 0:
+		errs = append(errs, &PipeError{Name: name, Field: "accept-proxy-protocol", Warning: true,
+			Err: fmt.Errorf("without trusted-proxies any peer can claim any client address")})
+	}
+	if pipe.IsUDP() {
+		// tcp only settings udp flows would ignore
+		for _, setting := range []struct {
+			field string
+			set   bool
+		}{
+			{"max-connections", pipe.MaxConnections != 0},
+			{"max-connections-per-client", pipe.MaxPerClient != 0},
+			{"proxy-protocol", len(pipe.ProxyProtocol) > 0},
+			{"accept-proxy-protocol", pipe.AcceptProxyProtocol},
+			{"bandwidth", pipe.Bandwidth != nil},
+			{"connection-rate", pipe.ConnectionRate != nil},
+			{"tls", pipe.TLS != nil},
+			{"sni", len(pipe.SNI) > 0},
+			{"health", pipe.HealthCheck != nil},
+		} {
+			if setting.set {
+				fail(setting.field, "not available on udp pipes")
+			}
+		}
+	}
+	switch pipe.OverLimit {
+	case "", "reject", "queue":
+	default:
+		fail("over-limit", "unknown %q, expected reject or queue", pipe.OverLimit)
+	}
+	switch pipe.ProxyProtocol {
+	case "", "v1", "v2":
+	default:
+		fail("proxy-protocol", "unknown version %q, expected v1 or v2", pipe.ProxyProtocol)
+	}
+	return
+}
+
+// hostPort parse address as host:port returning the port
+func hostPort(address string) (int, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return 0, err
+	}
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q in %q", port, address)
+	}
+	return int(number), nil
+}
+
+// unixPath check the path of a unix:// address
+func unixPath(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("unix socket path %q isn't absolute, use unix:///path/to.sock", path)
+	}
+	return nil
+}
+
+// duplicates pipes binding the same source, pipes routed by distinct
+// sni names share their source by design
+func duplicates(names []string, pipes *map[string]*listener.PipeDefinition) (errs []*PipeError) {
+	// first pipe name by source, and by source and sni name
+	var bound, routed = make(map[string]string), make(map[string]string)
+	for _, name := range names {
+		var pipe = (*pipes)[name]
+		if pipe == nil || len(pipe.Source) == 0 {
+			continue
+		}
+		var key = "tcp " + pipe.Source
+		if pipe.IsUDP() {
+			key = "udp " + pipe.Source
+		}
+		var first, ok = bound[key]
+		var route = key + " " + strings.ToLower(pipe.SNI)
+		if len(pipe.SNI) > 0 && !ok {
+			if first, ok = routed[route]; !ok {
+				routed[route] = name
+			}
+		}
+		if ok {
+			errs = append(errs, &PipeError{Name: name, Field: "source",
+				Err: fmt.Errorf("%s already used by %s", pipe.Source, first)})
+			continue
+		}
+		if len(pipe.SNI) == 0 {
+			for route, sni := range routed {
+				if strings.HasPrefix(route, key+" ") {
+					first, ok = sni, true
+				}
+			}
+			if ok {
+				errs = append(errs, &PipeError{Name: name, Field: "source",
+					Err: fmt.Errorf("%s already routed by sni for %s", pipe.Source, first)})
+				continue
+			}
+			bound[key] = name
+		}
+	}
+	return
+}
@@ -0,0 +1,96 @@
+package mgr
+
+import (
+	"strings"
+	"testing"
+)
+
+var _validations = []struct {
+	text     string
+	errors   []string
+	warnings []string
+}{
+	{"echo:\n  source: 127.0.0.1:8888\n  sink: echo.default:8080\n", nil, nil},
+	{"echo:\n  source: 0.0.0.0:80\n  sink: echo.default:8080\n", nil, []string{"echo: source: warning: privileged port 80"}},
+	{"echo:\n  source: 0.0.0.0\n  sink: echo.default:8080\n", []string{"echo: source: address 0.0.0.0: missing port"}, nil},
+	{"echo:\n  source: 0.0.0.0:http\n  sink: echo.default:8080\n", []string{"echo: source: invalid port"}, nil},
+	{"echo:\n  source: 0.0.0.0:8888\n  sink: echo.default:99999\n", []string{"echo: sink: invalid port"}, nil},
+	{"echo:\n  source: 0.0.0.0:8888\n", []string{"echo: sink: a sink or service is required"}, nil},
+	{"echo:\n  source: 0.0.0.0:8888\n  sink: echo:8080\n  service: echo\n", nil, []string{"echo: sink: warning: sink and service are both set"}},
+	{"echo:\n  source: 0.0.0.0:8888\n  service: echo\n  enableep: true\n", []string{"echo: enableep: needs both service and namespace"}, nil},
+	{"a:\n  source: 0.0.0.0:8888\n  sink: a:1\nb:\n  source: 0.0.0.0:8888\n  sink: b:1\n", []string{"b: source: 0.0.0.0:8888 already used by a"}, nil},
+	{"a:\n  source: 0.0.0.0:8888\n  sink: a:1\nb:\n  source: 0.0.0.0:8888\n  sink: b:1\n  protocol: udp\n", nil, nil},
+	{"a:\n  source: 0.0.0.0:8443\n  sink: a:1\n  sni: a.example.com\nb:\n  source: 0.0.0.0:8443\n  sink: b:1\n  sni: b.example.com\n", nil, nil},
+	{"a:\n  source: 0.0.0.0:8443\n  sink: a:1\n  sni: a.example.com\nb:\n  source: 0.0.0.0:8443\n  sink: b:1\n  sni: A.example.com\n", []string{"b: source: 0.0.0.0:8443 already used by a"}, nil},
+	{"a:\n  source: 0.0.0.0:8443\n  sink: a:1\n  sni: a.example.com\nb:\n  source: 0.0.0.0:8443\n  sink: b:1\n", []string{"b: source: 0.0.0.0:8443 already routed by sni for a"}, nil},
+	{"echo:\n  source: 0.0.0.0:8888\n  sink: echo:1\n  connect-timeout: 2s\n  idle-timeout: 5m\n  max-lifetime: 24h\n", nil, nil},
+	{"echo:\n  source: 0.0.0.0:8888\n  sink: echo:1\n  idle-timeout: -5m\n", []string{"echo: idle-timeout: negative duration"}, nil},
+	{"echo:\n  source: 0.0.0.0:8888\n  sink: echo:1\n  max-connections: 100\n  max-connections-per-client: 4\n  over-limit: queue\n  queue-timeout: 2s\n", nil, nil},
+	{"echo:\n  source: 0.0.0.0:8888\n  sink: echo:1\n  max-connections: -1\n  over-limit: drop\n", []string{"echo: max-connections: negative", "echo: over-limit: unknown"}, nil},
+	{"ssh:\n  source: 0.0.0.0:2222\n  sink: ssh:22\n  allow: [203.0.113.0/24, 2001:db8::/32, 198.51.100.7]\n  deny: [203.0.113.9]\n", nil, nil},
+	{"ssh:\n  source: 0.0.0.0:2222\n  sink: ssh:22\n  allow: [203.0.113.0/33]\n  deny: [office]\n", []string{"ssh: allow: invalid CIDR address", "ssh: deny: invalid address"}, nil},
+	{"backup:\n  source: 0.0.0.0:8873\n  sink: backup:873\n  bandwidth:\n    rate: 10485760\n    client-rate: 1048576\n    client-burst: 65536\n", nil, nil},
+	{"backup:\n  source: 0.0.0.0:8873\n  sink: backup:873\n  bandwidth:\n    rate: -1\n", []string{"backup: bandwidth: negative rate"}, nil},
+	{"api:\n  source: 0.0.0.0:8443\n  sink: api:443\n  connection-rate:\n    rate: 0.5\n    burst: 10\n    ban-after: 20\n    ban-duration: 10m\n", nil, nil},
+	{"api:\n  source: 0.0.0.0:8443\n  sink: api:443\n  connection-rate:\n    burst: 10\n", []string{"api: connection-rate: rate must be positive"}, nil},
+	{"lb:\n  source: 0.0.0.0:8443\n  sink: api:443\n  accept-proxy-protocol: true\n  trusted-proxies: [10.0.0.0/8]\n", nil, nil},
+	{"lb:\n  source: 0.0.0.0:8443\n  sink: api:443\n  accept-proxy-protocol: true\n", nil, []string{"lb: accept-proxy-protocol: warning: without trusted-proxies"}},
+	{"lb:\n  source: 0.0.0.0:8443\n  sink: api:443\n  trusted-proxies: [10.0.0.300]\n", []string{"lb: trusted-proxies: invalid address", "lb: trusted-proxies: needs accept-proxy-protocol"}, nil},
+	{"a:\n  source: 0.0.0.0:8443\n  sink: a:1\n  sni: a.example.com\n  accept-proxy-protocol: true\n  trusted-proxies: [10.0.0.0/8]\n", []string{"a: accept-proxy-protocol: not available on sni pipes"}, nil},
+	{"docker:\n  source: 127.0.0.1:2375\n  sink: unix:///var/run/docker.sock\n", nil, nil},
+	{"pg:\n  source: unix:///run/forwarder/pg.sock\n  sink: db:5432\n  socket:\n    mode: 0660\n    owner: \"70\"\n    group: postgres\n", nil, nil},
+	{"pg:\n  source: unix://pg.sock\n  sink: db:5432\n  protocol: udp\n  socket:\n    mode: \"0999\"\n", []string{"pg: source: unix socket path", "pg: protocol: udp can't use", "pg: socket: mode"}, nil},
+	{"dns:\n  source: 0.0.0.0:5353\n  sink: unix:///run/dns.sock\n  protocol: udp\n  socket:\n    mode: \"0600\"\n", []string{"dns: protocol: udp can't forward", "dns: socket: needs a unix:// source"}, nil},
+	{"dns:\n  source: 0.0.0.0:5353\n  sink: dns:53\n  protocol: udp\n  max-connections: 10\n  max-connections-per-client: 2\n  proxy-protocol: v1\n", []string{"dns: max-connections: not available on udp", "dns: max-connections-per-client: not available on udp", "dns: proxy-protocol: not available on udp"}, nil},
+	{"redis:\n  source: 0.0.0.0:6379\n  sink: redis:6379\n  health:\n    type: send-expect\n    send: PING\n    expect: PONG\n    interval: 5s\n", nil, nil},
+	{"redis:\n  source: 0.0.0.0:6379\n  sink: redis:6379\n  health:\n    type: htpp\n    rise: -1\n", []string{"redis: health: unknown type \"htpp\"", "redis: health: negative interval"}, nil},
+	{"redis:\n  source: 0.0.0.0:6379\n  sink: redis:6379\n  health:\n    type: send-expect\n    send: PING\n", []string{"redis: health: send-expect needs expect"}, nil},
+	{"dns:\n  source: 0.0.0.0:5353\n  sink: dns:53\n  protocol: udp\n  health:\n    interval: 20ms\n", []string{"dns: health: not available on udp"}, nil},
+	{"echo:\n  source: 0.0.0.0:8888\n  sink: echo:1\n  balance: fastest\n  proxy-protocol: v3\n", []string{"echo: balance: unknown balance", "echo: proxy-protocol: unknown version"}, nil},
+}
+
+func TestCheck(t *testing.T) {
+	for _, test := range _validations {
+		pipes, err := Parse([]byte(test.text), true)
+		if err != nil {
+			t.Fatalf("%q %v", test.text, err)
+		}
+		var errors, warnings []string
+		for _, problem := range Check(pipes) {
+			if problem.Warning {
+				warnings = append(warnings, problem.Error())
+			} else {
+				errors = append(errors, problem.Error())
+			}
+		}
+		if !prefixes(errors, test.errors) || !prefixes(warnings, test.warnings) {
+			t.Errorf("%q\nGot:\t\t%q %q\nExpected:\t%q %q\n", test.text, errors, warnings, test.errors, test.warnings)
+		}
+		if (Validate(pipes) == nil) != (len(test.errors) == 0) {
+			t.Errorf("%q Validate disagrees with Check", test.text)
+		}
+	}
+}
+
+func TestParseStrict(t *testing.T) {
+	var text = []byte("echo:\n  source: 0.0.0.0:8888\n  sink: echo:1\n  sinks: typo:1\n")
+	if _, err := Parse(text, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Parse(text, true); err == nil || !strings.Contains(err.Error(), "sinks") {
+		t.Fatalf("expected unknown key error got %v", err)
+	}
+}
+
+// prefixes each got starts with the matching expected text
+func prefixes(got, expected []string) bool {
+	if len(got) != len(expected) {
+		return false
+	}
+	for i := range got {
+		if !strings.HasPrefix(got[i], expected[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	mgmt "github.com/davidwalter0/forwarder/mgr"
+)
+
+// validate subcommand, check a pipes file without running it
+//
+//	forwarder validate -f pipes.yaml
+//
+// every problem is printed as file: pipe: field: message, the exit
+// status is 1 when any is an error or the yaml doesn't parse, 2 for
+// usage or unreadable files
+func validate(args []string, stdout, stderr io.Writer) int {
+	var flags = flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var file = flags.String("f", "pipes.yaml", "pipes file to validate")
+	var quiet = flags.Bool("q", false, "only report errors, not warnings")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if len(*file) == 0 {
+		flags.Usage()
+		return 2
+	}
+	text, err := mgmt.Load(*file)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", *file, err)
+		return 2
+	}
+	pipes, err := mgmt.Parse(text, true)
+	if err != nil {
+		// unknown keys and yaml syntax
+		fmt.Fprintf(stdout, "%s: %v\n", *file, err)
+		return 1
+	}
+	var errors, warnings int
+	for _, problem := range mgmt.Check(pipes) {
+		if problem.Warning {
+			warnings++
+			if *quiet {
+				continue
+			}
+		} else {
+			errors++
+		}
+		fmt.Fprintf(stdout, "%s: %v\n", *file, problem)
+	}
+	fmt.Fprintf(stdout, "%s: %d pipes, %d errors, %d warnings\n", *file, len(*pipes), errors, warnings)
+	if errors > 0 {
+		return 1
+	}
+	return 0
+}
+
+// subcommand run by name from the command line, false when args don't
+// name one
+func subcommand(args []string) (status int, ok bool) {
+	if len(args) > 0 && args[0] == "validate" {
+		return validate(args[1:], os.Stdout, os.Stderr), true
+	}
+	return 0, false
+}